@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"masque-plus/internal/httpcheck"
+	"masque-plus/internal/scanner"
+	"masque-plus/internal/usqueconfig"
+)
+
+// benchRow is one line of a benchmark report.
+type benchRow struct {
+	Endpoint string
+	Result   httpcheck.BenchResult
+	Err      error
+}
+
+// runBenchCmd implements `masque-plus bench [endpoint...]`: every endpoint
+// is started in turn and benchmarked through its SOCKS bind. With --socks
+// an already running proxy is measured instead.
+func runBenchCmd(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigFile, "usque config (identity) used for the endpoints")
+	socksAddr := fs.String("socks", "", "Benchmark an already running SOCKS proxy at IP:Port instead of starting endpoints")
+	bind := fs.String("bind", "", "IP:Port for the temporary usque SOCKS proxy (default: random loopback port)")
+	endpointsFile := fs.String("endpoints-file", "", "File with endpoints to benchmark (same format as the main --endpoints-file)")
+	connectTimeout := fs.Duration("connect-timeout", 15*time.Second, "How long to wait for each endpoint to connect")
+	opts := benchFlags(fs)
+	fs.StringVar(&sni, "sni", sni, "SNI address to use for MASQUE connection")
+	fs.StringVar(&username, "username", username, "Username for proxy authentication")
+	fs.StringVar(&password, "password", password, "Password for proxy authentication")
+	fs.BoolVar(&acceptTOS, "accept-tos", acceptTOS, "Accept the Cloudflare terms of service when re-registering a rejected identity")
+	fs.BoolVar(&registerNative, "register-native", registerNative, "Register directly against the API instead of running `usque register`")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: masque-plus bench [flags] [endpoint ...]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if opts.UploadURL == "" {
+		opts.UploadURL = httpcheck.DefaultBenchUpURL
+	}
+
+	if *socksAddr != "" {
+		res, err := httpcheck.Bench(socksProxy(*socksAddr), *opts)
+		printBench([]benchRow{{Endpoint: *socksAddr, Result: res, Err: err}})
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	endpoints := fs.Args()
+	if *endpointsFile != "" {
+		l, err := scanner.LoadEndpointFile(*endpointsFile, defaultScanPort)
+		if err != nil {
+			logErrorAndExit(err.Error())
+		}
+		endpoints = append(endpoints, l.Endpoints...)
+	}
+	if len(endpoints) == 0 {
+		if st, err := LoadState(); err == nil && st.Endpoint != "" {
+			endpoints = []string{st.Endpoint}
+		} else {
+			endpoints = defaultV4
+		}
+	}
+
+	cfg, err := usqueconfig.Load(*configFile)
+	if err != nil {
+		logErrorAndExit(fmt.Sprintf("failed to load config: %v (register first)", err))
+	}
+	if err := cfg.Validate(); err != nil {
+		logErrorAndExit(fmt.Sprintf("invalid config %s: %v", *configFile, err))
+	}
+	if *bind == "" {
+		port, err := freeLocalPort()
+		if err != nil {
+			logErrorAndExit(err.Error())
+		}
+		*bind = "127.0.0.1:" + strconv.Itoa(port)
+	}
+	bindIP, bindPort := mustSplitBind(*bind)
+
+	// a rejected account fails every endpoint: register once more and
+	// retry the endpoint it failed on
+	ids := &identitySwitch{usquePath: defaultUsquePath, configFile: *configFile}
+	var rows []benchRow
+	for i := 0; i < len(endpoints); i++ {
+		ep := endpoints[i]
+		row := benchRow{Endpoint: ep}
+		stop, ok, err := startCandidate(defaultUsquePath, cfg, *configFile, bindIP, bindPort, ep, sni, *connectTimeout, false, 2)
+		if isIdentityErr(err) {
+			if stop != nil {
+				stop()
+			}
+			cfg = ids.next(err)
+			i--
+			continue
+		}
+		switch {
+		case err != nil:
+			row.Err = err
+		case !ok:
+			row.Err = fmt.Errorf("not connected within %s", *connectTimeout)
+		default:
+			row.Result, row.Err = httpcheck.Bench(socksProxy(*bind), *opts)
+		}
+		if stop != nil {
+			stop()
+		}
+		rows = append(rows, row)
+	}
+	printBench(rows)
+}
+
+// benchFlags registers the payload flags shared by `bench` and --scan-bench.
+func benchFlags(fs *flag.FlagSet) *httpcheck.BenchOptions {
+	o := &httpcheck.BenchOptions{}
+	fs.StringVar(&o.DownloadURL, "bench-down-url", httpcheck.DefaultBenchDownURL, "Download URL for benchmarks (%d is replaced with --bench-bytes)")
+	fs.StringVar(&o.UploadURL, "bench-up-url", "", "Upload URL for benchmarks (empty skips the upload test; the bench command defaults to "+httpcheck.DefaultBenchUpURL+")")
+	fs.Int64Var(&o.Bytes, "bench-bytes", 5_000_000, "Payload size per benchmark round")
+	fs.IntVar(&o.Rounds, "bench-rounds", 3, "Benchmark rounds per endpoint")
+	return o
+}
+
+// bestBench returns the endpoint with the highest download rate, or "" if
+// none finished a benchmark.
+func bestBench(rows []benchRow) string {
+	best, bestMbps := "", -1.0
+	for _, r := range rows {
+		if r.Err == nil && r.Result.DownMbps > bestMbps {
+			best, bestMbps = r.Endpoint, r.Result.DownMbps
+		}
+	}
+	return best
+}
+
+func printBench(rows []benchRow) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tDOWN Mbps\tUP Mbps\tTTFB\tJITTER\tERROR")
+	for _, r := range rows {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t%v\n", r.Endpoint, r.Err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%.1f\t%.1f\t%s\t%s\t\n", r.Endpoint, r.Result.DownMbps, r.Result.UpMbps,
+			r.Result.TTFB.Round(time.Millisecond), r.Result.Jitter.Round(time.Millisecond))
+	}
+	_ = w.Flush()
+}
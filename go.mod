@@ -10,9 +10,11 @@ require (
 	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
 	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.43.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/tools v0.21.0 // indirect
 )
 
-require github.com/quic-go/quic-go v0.45.1
+require (
+	github.com/quic-go/quic-go v0.45.1
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
+)
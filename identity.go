@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"masque-plus/internal/identity"
+	"masque-plus/internal/logutil"
+	"masque-plus/internal/usqueconfig"
+)
+
+// Identity rotation modes for --identity-rotate.
+const (
+	rotateNone     = "none"
+	rotateInstance = "instance" // next identity on every start
+	rotateFailure  = "failure"  // next identity when the current one is rejected
+)
+
+// runIdentityCmd implements `masque-plus identity list|add|delete`.
+func runIdentityCmd(args []string) {
+	fs := flag.NewFlagSet("identity", flag.ExitOnError)
+	dir := fs.String("dir", identity.DefaultDir, "Directory holding named identities")
+	fs.BoolVar(&acceptTOS, "accept-tos", acceptTOS, "Accept the Cloudflare terms of service when registering")
+	fs.BoolVar(&registerNative, "register-native", registerNative, "Register directly against the API instead of running `usque register`")
+	fs.StringVar(&registerAPI, "register-api", registerAPI, "Base URL of the registration API (for --register-native)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: masque-plus identity [--dir DIR] [--accept-tos] list | add <name> | delete <name>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	pool := identity.Pool{Dir: *dir}
+	rest := fs.Args()
+	if len(rest) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch rest[0] {
+	case "list", "ls":
+		ids, err := pool.List()
+		if err != nil {
+			logErrorAndExit(err.Error())
+		}
+		if len(ids) == 0 {
+			fmt.Printf("no identities in %s\n", pool.Dir)
+			return
+		}
+		for _, id := range ids {
+			fmt.Printf("%-24s %s  %s\n", id.Name, id.ModTime.Format("2006-01-02 15:04"), id.Path)
+		}
+
+	case "add", "register":
+		if len(rest) != 2 {
+			logErrorAndExit("usage: masque-plus identity add <name>")
+		}
+		name := rest[1]
+		if err := identity.ValidateName(name); err != nil {
+			logErrorAndExit(err.Error())
+		}
+		if pool.Exists(name) {
+			logErrorAndExit(fmt.Sprintf("identity %q already exists; delete it first", name))
+		}
+		if err := os.MkdirAll(pool.Dir, 0700); err != nil {
+			logErrorAndExit(err.Error())
+		}
+		if err := runRegister(defaultUsquePath, pool.Path(name)); err != nil {
+			logErrorAndExit(fmt.Sprintf("failed to register %q: %v", name, err))
+		}
+		logInfo("identity registered", map[string]string{"name": name, "config": pool.Path(name)})
+
+	case "delete", "rm":
+		if len(rest) != 2 {
+			logErrorAndExit("usage: masque-plus identity delete <name>")
+		}
+		if err := pool.Delete(rest[1]); err != nil {
+			logErrorAndExit(err.Error())
+		}
+		logInfo("identity deleted", map[string]string{"name": rest[1]})
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// selectIdentity decides which config file to use for this run. It returns
+// the config path and the identity name ("" for the legacy config.json).
+func selectIdentity(pool identity.Pool, name, rotate, last string) (string, string) {
+	switch rotate {
+	case rotateNone, rotateInstance, rotateFailure:
+	default:
+		logErrorAndExit(fmt.Sprintf("invalid --identity-rotate %q (want none, instance or failure)", rotate))
+	}
+
+	if name != "" {
+		if err := identity.ValidateName(name); err != nil {
+			logErrorAndExit(err.Error())
+		}
+		if err := os.MkdirAll(pool.Dir, 0700); err != nil {
+			logErrorAndExit(err.Error())
+		}
+		return pool.Path(name), name
+	}
+	if rotate == rotateNone {
+		return defaultConfigFile, ""
+	}
+
+	ids, err := pool.List()
+	if err != nil || len(ids) == 0 {
+		logutil.Warn("--identity-rotate set but no identities found; using default config", map[string]string{"dir": pool.Dir})
+		return defaultConfigFile, ""
+	}
+
+	if rotate == rotateFailure && pool.Exists(last) {
+		return pool.Path(last), last
+	}
+	next, err := pool.Next(last)
+	if err != nil {
+		logErrorAndExit(err.Error())
+	}
+	return next.Path, next.Name
+}
+
+// nextUntriedIdentity returns the next identity after current that has not
+// been tried yet in this run.
+func nextUntriedIdentity(pool identity.Pool, current string, tried map[string]bool) (identity.Identity, bool) {
+	ids, err := pool.List()
+	if err != nil {
+		return identity.Identity{}, false
+	}
+	for range ids {
+		next, err := pool.Next(current)
+		if err != nil {
+			return identity.Identity{}, false
+		}
+		if !tried[next.Name] {
+			return next, true
+		}
+		current = next.Name
+	}
+	return identity.Identity{}, false
+}
+
+// identitySwitch replaces an identity usque rejected (login failed or bad
+// private key). With rotate it moves to the next untried identity in
+// pool, otherwise it registers once more in place; it exits when neither
+// is possible.
+type identitySwitch struct {
+	pool       identity.Pool
+	rotate     bool
+	usquePath  string
+	configFile string
+	name       string
+
+	tried        map[string]bool
+	reRegistered bool
+}
+
+// next switches away from the rejected identity and returns the config of
+// the new one, also pinning its endpoint key for prechecks.
+func (s *identitySwitch) next(err error) *usqueconfig.Config {
+	if s.tried == nil {
+		s.tried = map[string]bool{s.name: true}
+	}
+	rotated := false
+	if s.rotate {
+		if next, ok := nextUntriedIdentity(s.pool, s.name, s.tried); ok {
+			logutil.Warn("identity rejected; rotating", map[string]string{
+				"identity": s.name,
+				"next":     next.Name,
+				"error":    err.Error(),
+			})
+			s.tried[next.Name] = true
+			s.configFile, s.name = next.Path, next.Name
+			rotated = true
+		}
+	}
+	if !rotated {
+		if s.reRegistered {
+			logErrorAndExit(fmt.Sprintf("identity rejected after re-registration: %v", err))
+		}
+		s.reRegistered = true
+		logutil.Warn("identity rejected; re-registering", map[string]string{
+			"config": s.configFile,
+			"error":  err.Error(),
+		})
+		if err := reRegister(s.usquePath, s.configFile); err != nil {
+			logErrorAndExit(fmt.Sprintf("re-registration failed: %v", err))
+		}
+	}
+	cfg, lerr := usqueconfig.Load(s.configFile)
+	if lerr != nil {
+		logErrorAndExit(fmt.Sprintf("failed to load config: %v", lerr))
+	}
+	if lerr = cfg.Validate(); lerr != nil {
+		logErrorAndExit(fmt.Sprintf("invalid config %s: %v", s.configFile, lerr))
+	}
+	if endpointKey, lerr = cfg.PeerKey(); lerr != nil {
+		logErrorAndExit(fmt.Sprintf("invalid config %s: %v", s.configFile, lerr))
+	}
+	return cfg
+}
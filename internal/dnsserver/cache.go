@@ -0,0 +1,143 @@
+package dnsserver
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	minCacheTTL = 5 * time.Second
+	maxCacheTTL = 1 * time.Hour
+	negCacheTTL = 30 * time.Second
+)
+
+// Cache is a small LRU of DNS answers keyed by question, honoring TTLs.
+type Cache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	msg     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// NewCache returns a cache holding up to size answers.
+func NewCache(size int) *Cache {
+	return &Cache{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// cacheKey identifies a question. Queries with and without EDNS0 and with
+// and without the DO bit get different answers (OPT record, DNSSEC
+// signatures), so they are cached apart. The UDP size is not part of the
+// key: truncated answers are never cached and the limit is applied when
+// sending.
+func cacheKey(q dnsmessage.Question, edns, do bool) string {
+	return fmt.Sprintf("%s|%s|%s|edns=%t|do=%t", strings.ToLower(q.Name.String()), q.Type, q.Class, edns, do)
+}
+
+// Get returns a cached answer rewritten for the given query ID with TTLs
+// reduced by the time spent in the cache, or nil on a miss.
+func (c *Cache) Get(key string, id uint16) []byte {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.mu.Unlock()
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	raw, stored := e.msg, e.stored
+	c.mu.Unlock()
+
+	var m dnsmessage.Message
+	if err := m.Unpack(raw); err != nil {
+		return nil
+	}
+	m.ID = id
+	age := uint32(time.Since(stored) / time.Second)
+	for _, sec := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range sec {
+			if sec[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if sec[i].Header.TTL > age {
+				sec[i].Header.TTL -= age
+			} else {
+				sec[i].Header.TTL = 0
+			}
+		}
+	}
+	out, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// Put stores a successful or NXDOMAIN answer. Other failures are not cached.
+func (c *Cache) Put(key string, msg []byte) {
+	ttl, ok := answerTTL(msg)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	e := &cacheEntry{key: key, msg: msg, stored: now, expires: now.Add(ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.size {
+		old := c.ll.Back()
+		c.ll.Remove(old)
+		delete(c.items, old.Value.(*cacheEntry).key)
+	}
+}
+
+func answerTTL(msg []byte) (time.Duration, bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return 0, false
+	}
+	switch m.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return negCacheTTL, true
+	default:
+		return 0, false
+	}
+	if m.Truncated || len(m.Answers) == 0 {
+		return negCacheTTL, len(m.Answers) == 0 && !m.Truncated
+	}
+
+	ttl := maxCacheTTL
+	for _, a := range m.Answers {
+		if d := time.Duration(a.Header.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	if ttl < minCacheTTL {
+		ttl = minCacheTTL
+	}
+	return ttl, true
+}
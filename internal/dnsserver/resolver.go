@@ -0,0 +1,144 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrNotFound is returned when a name has no A/AAAA records.
+var ErrNotFound = errors.New("no addresses found")
+
+// Resolver looks up host addresses outside the tunnel, either with the
+// system resolver or with an explicit Upstream (e.g. DoH), so endpoint
+// hostnames can be resolved before the tunnel exists.
+type Resolver struct {
+	Upstream Upstream      // nil: system resolver
+	Timeout  time.Duration // per attempt, default 5s
+	Retries  int           // extra attempts for transient errors
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host in answer order.
+// Transient failures (timeouts, SERVFAIL, network errors) are retried with
+// a short backoff; a missing name fails immediately.
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	delay := 500 * time.Millisecond
+	var err error
+	for i := 0; i <= r.Retries; i++ {
+		if i > 0 {
+			time.Sleep(delay + time.Duration(rand.Int63n(int64(delay)/2+1)))
+			delay *= 2
+		}
+		var ips []net.IP
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if r.Upstream == nil {
+			ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+		} else {
+			ips, err = r.lookupUpstream(ctx, host)
+		}
+		cancel()
+		if err == nil {
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("%s: %w", host, ErrNotFound)
+			}
+			return ips, nil
+		}
+		if !transient(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (r *Resolver) lookupUpstream(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var lastErr error
+	found := false
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		got, err := r.query(ctx, host, t)
+		if errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		found = true
+		ips = append(ips, got...)
+	}
+	if !found {
+		return nil, lastErr
+	}
+	return ips, nil
+}
+
+func (r *Resolver) query(ctx context.Context, host string, t dnsmessage.Type) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := r.Upstream.Exchange(ctx, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if m.Header.ID != id {
+		return nil, fmt.Errorf("%s: mismatched DNS response id", r.Upstream)
+	}
+	switch m.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, fmt.Errorf("%s: %w", host, ErrNotFound)
+	default:
+		return nil, &net.DNSError{Err: m.Header.RCode.String(), Name: host, Server: r.Upstream.String(), IsTemporary: true}
+	}
+
+	var ips []net.IP
+	for _, a := range m.Answers {
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]))
+		}
+	}
+	return ips, nil
+}
+
+// transient reports whether a lookup error is worth retrying.
+func transient(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	var de *net.DNSError
+	if errors.As(err, &de) {
+		return de.IsTimeout || de.IsTemporary || !de.IsNotFound
+	}
+	return true
+}
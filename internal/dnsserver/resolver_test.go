@@ -0,0 +1,126 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"not found", fmt.Errorf("x.test: %w", ErrNotFound), false},
+		{"nxdomain", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{"servfail", &net.DNSError{Err: "ServFail", IsTemporary: true}, true},
+		{"other dns error", &net.DNSError{Err: "server misbehaving"}, true},
+		{"deadline", context.DeadlineExceeded, true},
+		{"network", errors.New("connection refused"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transient(tt.err); got != tt.want {
+				t.Errorf("transient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// step is one scripted upstream reply: an exchange error, or a response
+// with rcode carrying one address of the queried type unless empty.
+type step struct {
+	err   error
+	rcode dnsmessage.RCode
+	empty bool
+}
+
+// scriptedUpstream plays steps in order, repeating the last one.
+type scriptedUpstream struct {
+	mu    sync.Mutex
+	steps []step
+	calls int
+}
+
+func (s *scriptedUpstream) String() string { return "scripted" }
+
+func (s *scriptedUpstream) Exchange(_ context.Context, query []byte) ([]byte, error) {
+	s.mu.Lock()
+	st := s.steps[min(s.calls, len(s.steps)-1)]
+	s.calls++
+	s.mu.Unlock()
+	if st.err != nil {
+		return nil, st.err
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		return nil, err
+	}
+	m.Response = true
+	m.RCode = st.rcode
+	q := m.Questions[0]
+	if st.rcode == dnsmessage.RCodeSuccess && !st.empty {
+		h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+		if q.Type == dnsmessage.TypeA {
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+		} else {
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}})
+		}
+	}
+	return m.Pack()
+}
+
+func TestLookupIP(t *testing.T) {
+	ok := step{rcode: dnsmessage.RCodeSuccess}
+	servfail := step{rcode: dnsmessage.RCodeServerFailure}
+	tests := []struct {
+		name    string
+		host    string
+		retries int
+		steps   []step
+		want    []string
+		wantErr error // matched with errors.Is; nil with want empty means any error
+		calls   int
+	}{
+		{"both families", "x.test", 0, []step{ok}, []string{"192.0.2.1", "2001:db8::1"}, nil, 2},
+		{"ip literal", "192.0.2.9", 3, []step{ok}, []string{"192.0.2.9"}, nil, 0},
+		{"one family fails", "x.test", 0, []step{ok, servfail}, []string{"192.0.2.1"}, nil, 2},
+		{"nxdomain is final", "x.test", 3, []step{{rcode: dnsmessage.RCodeNameError}}, nil, ErrNotFound, 1},
+		{"no records", "x.test", 3, []step{{empty: true}}, nil, ErrNotFound, 2},
+		{"servfail without retries", "x.test", 0, []step{servfail}, nil, nil, 2},
+		{"servfail retried", "x.test", 1, []step{servfail, servfail, ok}, []string{"192.0.2.1", "2001:db8::1"}, nil, 4},
+		{"network error retried", "x.test", 1, []step{{err: errors.New("connection refused")}, {err: errors.New("connection refused")}, ok}, []string{"192.0.2.1", "2001:db8::1"}, nil, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := &scriptedUpstream{steps: tt.steps}
+			r := &Resolver{Upstream: up, Retries: tt.retries}
+			ips, err := r.LookupIP(tt.host)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			case len(tt.want) == 0:
+				if err == nil {
+					t.Errorf("LookupIP = %v, want an error", ips)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(ips); len(tt.want) > 0 && got != fmt.Sprint(tt.want) {
+				t.Errorf("LookupIP = %s, want %v", got, tt.want)
+			}
+			if up.calls != tt.calls {
+				t.Errorf("%d upstream queries, want %d", up.calls, tt.calls)
+			}
+		})
+	}
+}
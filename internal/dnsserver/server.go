@@ -0,0 +1,236 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"masque-plus/internal/logutil"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Server is a local DNS listener (UDP and TCP on the same address) that
+// forwards queries to upstreams reachable through the tunnel.
+type Server struct {
+	Listen    string
+	Upstreams []Upstream          // tried in order
+	Routes    map[string]Upstream // domain suffix -> upstream, longest match wins
+	Timeout   time.Duration       // per upstream attempt
+	Cache     *Cache              // optional
+}
+
+// ListenAndServe starts the UDP and TCP listeners and blocks until one fails.
+func (s *Server) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", s.Listen)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	names := make([]string, 0, len(s.Upstreams))
+	for _, u := range s.Upstreams {
+		names = append(names, u.String())
+	}
+	logutil.Info("local DNS server listening", map[string]string{
+		"address":   s.Listen,
+		"upstreams": strings.Join(names, ","),
+	})
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.serveUDP(pc) }()
+	go func() { errCh <- s.serveTCP(ln) }()
+	return <-errCh
+}
+
+func (s *Server) serveUDP(pc net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		q := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp := s.resolve(q)
+			if resp != nil {
+				size, _, _ := edns(q)
+				_, _ = pc.WriteTo(truncate(resp, size), addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			for {
+				_ = c.SetDeadline(time.Now().Add(30 * time.Second))
+				var l [2]byte
+				if _, err := io.ReadFull(c, l[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				resp := s.resolve(q)
+				if resp == nil {
+					return
+				}
+				out := make([]byte, 2+len(resp))
+				binary.BigEndian.PutUint16(out, uint16(len(resp)))
+				copy(out[2:], resp)
+				if _, err := c.Write(out); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// resolve answers a raw query from cache or upstream. On total failure it
+// returns SERVFAIL so clients don't hang; nil means the query was unparsable.
+func (s *Server) resolve(query []byte) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	_, do, hasOPT := edns(query)
+	key := cacheKey(q, hasOPT, do)
+	if s.Cache != nil {
+		if resp := s.Cache.Get(key, hdr.ID); resp != nil {
+			return resp
+		}
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	var lastErr error
+	for _, up := range s.upstreamsFor(q.Name.String()) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp, err := up.Exchange(ctx, query)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if s.Cache != nil {
+			s.Cache.Put(key, resp)
+		}
+		return resp
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no upstream configured")
+	}
+	logutil.Warn("dns query failed", map[string]string{
+		"name":  q.Name.String(),
+		"type":  q.Type.String(),
+		"error": lastErr.Error(),
+	})
+	return servfail(hdr, q)
+}
+
+func (s *Server) upstreamsFor(name string) []Upstream {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for n := name; n != ""; {
+		if up, ok := s.Routes[n]; ok {
+			return []Upstream{up}
+		}
+		i := strings.IndexByte(n, '.')
+		if i < 0 {
+			break
+		}
+		n = n[i+1:]
+	}
+	return s.Upstreams
+}
+
+// edns returns the UDP payload size a query allows (512 without EDNS0),
+// its DO bit, and whether it carries an OPT record at all.
+func edns(query []byte) (size int, do, ok bool) {
+	size = 512
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return size, false, false
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return size, false, false
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return size, false, false
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			if n := int(h.Class); n > size {
+				size = n
+			}
+			return size, h.DNSSECAllowed(), true
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return size, false, false
+		}
+	}
+}
+
+// truncate cuts a UDP answer that doesn't fit in size down to its header,
+// question and OPT record with TC set, so the client retries over TCP.
+func truncate(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return resp[:size]
+	}
+	m.Truncated = true
+	m.Answers, m.Authorities = nil, nil
+	var opt []dnsmessage.Resource
+	for _, r := range m.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			opt = append(opt, r)
+		}
+	}
+	m.Additionals = opt
+	out, err := m.Pack()
+	if err != nil {
+		return resp[:size]
+	}
+	return out
+}
+
+func servfail(hdr dnsmessage.Header, q dnsmessage.Question) []byte {
+	hdr.Response = true
+	hdr.RCode = dnsmessage.RCodeServerFailure
+	msg := dnsmessage.Message{Header: hdr, Questions: []dnsmessage.Question{q}}
+	out, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
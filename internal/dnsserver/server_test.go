@@ -0,0 +1,177 @@
+package dnsserver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUpstream answers every A query with n addresses and counts calls.
+type fakeUpstream struct {
+	n     int
+	ttl   uint32
+	calls atomic.Int32
+}
+
+func (f *fakeUpstream) String() string { return "fake" }
+
+func (f *fakeUpstream) Exchange(_ context.Context, query []byte) ([]byte, error) {
+	f.calls.Add(1)
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		return nil, err
+	}
+	m.Response = true
+	for i := 0; i < f.n; i++ {
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: f.ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, byte(i >> 8), byte(i)}},
+		})
+	}
+	return m.Pack()
+}
+
+func buildQuery(t *testing.T, id uint16, name string, udpSize uint16, do bool) []byte {
+	t.Helper()
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET,
+		}},
+	}
+	if udpSize > 0 {
+		var h dnsmessage.ResourceHeader
+		if err := h.SetEDNS0(int(udpSize), dnsmessage.RCodeSuccess, do); err != nil {
+			t.Fatal(err)
+		}
+		m.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+	}
+	out, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestEDNS(t *testing.T) {
+	tests := []struct {
+		name    string
+		udpSize uint16
+		do      bool
+		size    int
+		wantDO  bool
+		wantOPT bool
+	}{
+		{"no EDNS", 0, false, 512, false, false},
+		{"EDNS 1232", 1232, false, 1232, false, true},
+		{"EDNS with DO", 4096, true, 4096, true, true},
+		{"EDNS below 512", 256, false, 512, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, do, ok := edns(buildQuery(t, 1, "example.com.", tt.udpSize, tt.do))
+			if size != tt.size || do != tt.wantDO || ok != tt.wantOPT {
+				t.Errorf("edns = (%d, %v, %v), want (%d, %v, %v)", size, do, ok, tt.size, tt.wantDO, tt.wantOPT)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	up := &fakeUpstream{n: 60, ttl: 300}
+	s := &Server{Upstreams: []Upstream{up}}
+	tests := []struct {
+		name      string
+		udpSize   uint16
+		truncated bool
+	}{
+		{"fits EDNS size", 4096, false},
+		{"too big for 512", 0, true},
+		{"too big for EDNS size", 600, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := buildQuery(t, 7, "big.example.", tt.udpSize, false)
+			size, _, _ := edns(q)
+			out := truncate(s.resolve(q), size)
+			if len(out) > size {
+				t.Fatalf("answer is %d bytes, limit %d", len(out), size)
+			}
+			var m dnsmessage.Message
+			if err := m.Unpack(out); err != nil {
+				t.Fatal(err)
+			}
+			if m.Truncated != tt.truncated {
+				t.Errorf("TC = %v, want %v", m.Truncated, tt.truncated)
+			}
+			if tt.truncated && (len(m.Answers) != 0 || len(m.Questions) != 1 || m.ID != 7) {
+				t.Errorf("truncated answer has %d answers, %d questions, ID %d", len(m.Answers), len(m.Questions), m.ID)
+			}
+			if !tt.truncated && len(m.Answers) != up.n {
+				t.Errorf("got %d answers, want %d", len(m.Answers), up.n)
+			}
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	up := &fakeUpstream{n: 1, ttl: 300}
+	s := &Server{Upstreams: []Upstream{up}, Cache: NewCache(2)}
+
+	queries := []struct {
+		name    string
+		udpSize uint16
+		do      bool
+		calls   int32 // upstream calls after this query
+	}{
+		{"a.example.", 0, false, 1},
+		{"a.example.", 0, false, 1},    // hit
+		{"A.EXAMPLE.", 0, false, 1},    // names are case-insensitive
+		{"a.example.", 1232, false, 2}, // EDNS0 is cached apart
+		{"a.example.", 4096, false, 2}, // the UDP size is not part of the key
+		{"a.example.", 1232, true, 3},  // nor is the DO bit shared
+		{"a.example.", 0, false, 4},    // evicted: the cache holds 2 answers
+	}
+	for i, q := range queries {
+		resp := s.resolve(buildQuery(t, uint16(100+i), q.name, q.udpSize, q.do))
+		var m dnsmessage.Message
+		if err := m.Unpack(resp); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if m.ID != uint16(100+i) {
+			t.Errorf("query %d: answer ID %d, want %d", i, m.ID, 100+i)
+		}
+		if got := up.calls.Load(); got != q.calls {
+			t.Errorf("query %d (%s edns=%d do=%v): %d upstream calls, want %d", i, q.name, q.udpSize, q.do, got, q.calls)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  dnsmessage.Message
+		ok   bool
+	}{
+		{"success", dnsmessage.Message{Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("a."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{},
+		}}}, true},
+		{"nxdomain", dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}, true},
+		{"servfail", dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}, false},
+		{"truncated", dnsmessage.Message{Header: dnsmessage.Header{Truncated: true}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := tt.msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := answerTTL(raw); ok != tt.ok {
+				t.Errorf("cacheable = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Upstream forwards a raw DNS query and returns the raw answer.
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// ParseUpstream builds an upstream from a URL:
+//
+//	https://cloudflare-dns.com/dns-query  DNS-over-HTTPS
+//	tls://1.1.1.1:853                     DNS-over-TLS (tls://host#servername also accepted)
+//	tcp://1.1.1.1:53                      plain DNS over TCP
+//	udp://192.168.1.1:53                  plain DNS over UDP, sent directly
+//
+// All upstreams except udp:// dial through d, so queries travel inside the
+// tunnel; udp:// is meant for per-domain routes that should bypass it.
+func ParseUpstream(raw string, d proxy.ContextDialer) (Upstream, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		return newDoH(raw, d), nil
+	case "tls":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "853")
+		}
+		sn := u.Fragment
+		if sn == "" {
+			sn = u.Hostname()
+		}
+		return &streamUpstream{addr: host, serverName: sn, dialer: d, name: raw}, nil
+	case "tcp":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "53")
+		}
+		return &streamUpstream{addr: host, dialer: d, name: raw}, nil
+	case "udp":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "53")
+		}
+		return &udpUpstream{addr: host, name: raw}, nil
+	}
+	return nil, fmt.Errorf("unsupported DNS upstream %q (want https://, tls://, tcp:// or udp://)", raw)
+}
+
+// ---- DNS-over-HTTPS ----
+
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoH(u string, d proxy.ContextDialer) *dohUpstream {
+	return &dohUpstream{
+		url: u,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         d.DialContext,
+				Proxy:               nil,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+}
+
+func (u *dohUpstream) String() string { return u.url }
+
+func (u *dohUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+// ---- DNS over TCP / TLS ----
+
+type streamUpstream struct {
+	addr       string
+	serverName string // set for DoT
+	dialer     proxy.ContextDialer
+	name       string
+}
+
+func (u *streamUpstream) String() string { return u.name }
+
+func (u *streamUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+
+	if u.serverName != "" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.serverName})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+	return exchangeStream(conn, query)
+}
+
+// exchangeStream writes a length-prefixed query and reads one answer (RFC 1035 4.2.2).
+func exchangeStream(rw io.ReadWriter, query []byte) ([]byte, error) {
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+	if _, err := rw.Write(buf); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(rw, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ---- direct UDP ----
+
+type udpUpstream struct {
+	addr string
+	name string
+}
+
+func (u *udpUpstream) String() string { return u.name }
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// ParseRoutes parses "suffix=upstream" pairs (e.g. "example.ir=tcp://10.0.0.1:53").
+func ParseRoutes(entries []string, d proxy.ContextDialer) (map[string]Upstream, error) {
+	out := make(map[string]Upstream, len(entries))
+	for _, e := range entries {
+		k, v, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid DNS route %q (want suffix=upstream)", e)
+		}
+		up, err := ParseUpstream(strings.TrimSpace(v), d)
+		if err != nil {
+			return nil, err
+		}
+		out[strings.Trim(strings.ToLower(strings.TrimSpace(k)), ".")] = up
+	}
+	return out, nil
+}
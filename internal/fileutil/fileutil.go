@@ -0,0 +1,33 @@
+// Package fileutil holds file helpers shared by the launcher's packages.
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteAtomic replaces path with data through a temp file in the same
+// directory and a rename, so a crash mid-write never leaves a truncated
+// file behind. The file gets mode 0600.
+func WriteAtomic(path string, data []byte) error {
+	// CreateTemp opens the file with mode 0600.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
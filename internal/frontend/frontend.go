@@ -0,0 +1,341 @@
+package frontend
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"masque-plus/internal/logutil"
+	"masque-plus/internal/router"
+
+	"golang.org/x/net/proxy"
+)
+
+// Server is a combined SOCKS5/HTTP proxy that routes each connection either
+// directly or through the usque SOCKS backend, according to the router rules.
+type Server struct {
+	Listen   string // address clients connect to
+	Backend  string // usque SOCKS address
+	Username string // optional; required from clients and sent to the backend
+	Password string
+	Router   *router.Router
+
+	DialTimeout time.Duration
+}
+
+// ListenAndServe accepts connections until the listener fails.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	logutil.Info("split-tunnel front-end listening", map[string]string{
+		"address": s.Listen,
+		"backend": s.Backend,
+	})
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == 0x05 {
+		err = s.serveSOCKS(c, br)
+	} else {
+		err = s.serveHTTP(c, br)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		logutil.Warn("front-end connection error", map[string]string{
+			"client": c.RemoteAddr().String(),
+			"error":  err.Error(),
+		})
+	}
+}
+
+// dial picks the route for host:port and opens the outbound connection.
+func (s *Server) dial(host, port string) (net.Conn, router.Action, error) {
+	rs := s.Router.Rules()
+
+	var ips []net.IP
+	if net.ParseIP(host) == nil && rs.HasIPRules() {
+		// Only resolve locally when no domain rule already decides the route.
+		if !rs.MatchesDomain(host) {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+			cancel()
+			if err == nil {
+				ips = addrs
+			}
+		}
+	}
+	act := rs.Match(host, ips)
+
+	timeout := s.DialTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	addr := net.JoinHostPort(host, port)
+
+	if act == router.ActionDirect {
+		c, err := net.DialTimeout("tcp", addr, timeout)
+		return c, act, err
+	}
+
+	var auth *proxy.Auth
+	if s.Username != "" && s.Password != "" {
+		auth = &proxy.Auth{User: s.Username, Password: s.Password}
+	}
+	d, err := proxy.SOCKS5("tcp", s.Backend, auth, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, act, err
+	}
+	c, err := d.Dial("tcp", addr)
+	return c, act, err
+}
+
+// ------------------------ SOCKS5 ------------------------
+
+func (s *Server) serveSOCKS(c net.Conn, br *bufio.Reader) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+
+	want := byte(0x00) // no auth
+	if s.Username != "" && s.Password != "" {
+		want = 0x02 // username/password
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		_, _ = c.Write([]byte{0x05, 0xff})
+		return fmt.Errorf("socks: no acceptable auth method")
+	}
+	if _, err := c.Write([]byte{0x05, want}); err != nil {
+		return err
+	}
+	if want == 0x02 {
+		if err := s.socksAuth(c, br); err != nil {
+			return err
+		}
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return err
+	}
+	if req[1] != 0x01 { // only CONNECT
+		_, _ = c.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return fmt.Errorf("socks: unsupported command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case 0x01:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return err
+		}
+		host = net.IP(b).String()
+	case 0x04:
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return err
+		}
+		host = net.IP(b).String()
+	case 0x03:
+		l, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return err
+		}
+		host = string(b)
+	default:
+		_, _ = c.Write([]byte{0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return fmt.Errorf("socks: unsupported address type %d", req[3])
+	}
+	pb := make([]byte, 2)
+	if _, err := io.ReadFull(br, pb); err != nil {
+		return err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(pb)))
+
+	up, act, err := s.dial(host, port)
+	if err != nil {
+		_, _ = c.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return fmt.Errorf("%s %s:%s: %w", act, host, port, err)
+	}
+	defer up.Close()
+
+	if _, err := c.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	pipe(c, br, up)
+	return nil
+}
+
+func (s *Server) socksAuth(c net.Conn, br *bufio.Reader) error {
+	ver, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ver != 0x01 {
+		return fmt.Errorf("socks: bad auth version %d", ver)
+	}
+	readStr := func() (string, error) {
+		l, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+	user, err := readStr()
+	if err != nil {
+		return err
+	}
+	pass, err := readStr()
+	if err != nil {
+		return err
+	}
+	if user != s.Username || pass != s.Password {
+		_, _ = c.Write([]byte{0x01, 0x01})
+		return fmt.Errorf("socks: authentication failed")
+	}
+	_, err = c.Write([]byte{0x01, 0x00})
+	return err
+}
+
+// ------------------------ HTTP ------------------------
+
+func (s *Server) serveHTTP(c net.Conn, br *bufio.Reader) error {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return err
+	}
+
+	if s.Username != "" && s.Password != "" {
+		user, pass, ok := proxyAuth(req)
+		if !ok || user != s.Username || pass != s.Password {
+			_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"masque-plus\"\r\nContent-Length: 0\r\n\r\n")
+			return nil
+		}
+	}
+
+	if req.Method == http.MethodConnect {
+		host, port, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host, port = req.Host, "443"
+		}
+		up, act, err := s.dial(host, port)
+		if err != nil {
+			_, _ = io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return fmt.Errorf("%s %s: %w", act, req.Host, err)
+		}
+		defer up.Close()
+		if _, err := io.WriteString(c, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return err
+		}
+		pipe(c, br, up)
+		return nil
+	}
+
+	if req.URL.Host == "" {
+		_, _ = io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+		return fmt.Errorf("http: request without absolute URL")
+	}
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		host, port = req.URL.Host, "80"
+	}
+	up, act, err := s.dial(host, port)
+	if err != nil {
+		_, _ = io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return fmt.Errorf("%s %s: %w", act, req.URL.Host, err)
+	}
+	defer up.Close()
+
+	// One request per connection keeps the plain-HTTP path simple.
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Header.Set("Connection", "close")
+	req.Close = true
+	if err := req.Write(up); err != nil {
+		return err
+	}
+	_, err = io.Copy(c, up)
+	return err
+}
+
+func proxyAuth(req *http.Request) (string, string, bool) {
+	h := req.Header.Get("Proxy-Authorization")
+	if h == "" {
+		return "", "", false
+	}
+	r := &http.Request{Header: http.Header{"Authorization": {h}}}
+	return r.BasicAuth()
+}
+
+// pipe copies data both ways until either side closes. Buffered client bytes
+// in br are forwarded first.
+func pipe(c net.Conn, br *bufio.Reader, up net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(up, br)
+		closeWrite(up)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(c, up)
+		closeWrite(c)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.SetReadDeadline(time.Now())
+}
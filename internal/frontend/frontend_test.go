@@ -0,0 +1,368 @@
+package frontend
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"masque-plus/internal/router"
+
+	"golang.org/x/net/proxy"
+)
+
+// Loopback destinations go direct and everything else takes the backend.
+// The proxied.test rule decides those names without resolving them.
+const testRules = `
+cidr,127.0.0.0/8,direct
+domain-suffix,proxied.test,proxy
+final,proxy
+`
+
+// fakeBackend stands in for usque's SOCKS5 server: it records the targets
+// it is asked for and connects every one of them to upstream instead.
+type fakeBackend struct {
+	t          *testing.T
+	user, pass string
+	upstream   string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (b *fakeBackend) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return
+	}
+	want := byte(0x00)
+	if b.user != "" {
+		want = 0x02
+	}
+	if !strings.ContainsRune(string(methods), rune(want)) {
+		_, _ = c.Write([]byte{0x05, 0xff})
+		return
+	}
+	_, _ = c.Write([]byte{0x05, want})
+	if want == 0x02 {
+		readStr := func() string {
+			l, _ := br.ReadByte()
+			s := make([]byte, l)
+			_, _ = io.ReadFull(br, s)
+			return string(s)
+		}
+		_, _ = br.ReadByte() // version
+		if readStr() != b.user || readStr() != b.pass {
+			b.t.Errorf("backend got the wrong credentials")
+			_, _ = c.Write([]byte{0x01, 0x01})
+			return
+		}
+		_, _ = c.Write([]byte{0x01, 0x00})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make([]byte, 4)
+		if req[3] == 0x04 {
+			ip = make([]byte, 16)
+		}
+		_, _ = io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		l, _ := br.ReadByte()
+		name := make([]byte, l)
+		_, _ = io.ReadFull(br, name)
+		host = string(name)
+	}
+	pb := make([]byte, 2)
+	_, _ = io.ReadFull(br, pb)
+	b.mu.Lock()
+	b.targets = append(b.targets, net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(pb))))
+	b.mu.Unlock()
+
+	up, err := net.Dial("tcp", b.upstream)
+	if err != nil {
+		_, _ = c.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer up.Close()
+	_, _ = c.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	pipe(c, br, up)
+}
+
+func (b *fakeBackend) seen() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.targets...)
+}
+
+// listen serves each accepted connection with handle until the test ends.
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echo answers with tag and a newline, then echoes what it reads.
+func echo(t *testing.T, tag string) string {
+	return listen(t, func(c net.Conn) {
+		defer c.Close()
+		_, _ = io.WriteString(c, tag+"\n")
+		_, _ = io.Copy(c, c)
+	})
+}
+
+// newServer starts a front-end in front of a fake backend whose traffic all
+// lands on upstream.
+func newServer(t *testing.T, user, pass, upstream string) (*fakeBackend, string) {
+	t.Helper()
+	rules := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(rules, []byte(testRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := router.New(rules, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBackend{t: t, user: user, pass: pass, upstream: upstream}
+	s := &Server{
+		Backend:     listen(t, b.serve),
+		Username:    user,
+		Password:    pass,
+		Router:      r,
+		DialTimeout: 2 * time.Second,
+	}
+	s.Listen = listen(t, s.handle)
+	return b, s.Listen
+}
+
+// roundTrip reads the tag from c, then checks a line comes back unchanged.
+func roundTrip(t *testing.T, c net.Conn) string {
+	t.Helper()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	tag, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading tag: %v", err)
+	}
+	if _, err := io.WriteString(c, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := br.ReadString('\n'); err != nil || got != "ping\n" {
+		t.Errorf("echo = %q, %v", got, err)
+	}
+	return strings.TrimSpace(tag)
+}
+
+func TestSOCKS(t *testing.T) {
+	direct := echo(t, "direct")
+	_, directPort, _ := net.SplitHostPort(direct)
+	tests := []struct {
+		name       string
+		user, pass string // server credentials
+		auth       *proxy.Auth
+		target     string
+		want       string // "" when the connection must fail
+		backend    string // target the backend should see
+	}{
+		{"direct by cidr", "", "", nil, direct, "direct", ""},
+		{"proxied domain", "", "", nil, "www.proxied.test:443", "proxy", "www.proxied.test:443"},
+		{"proxied ip", "", "", nil, "192.0.2.1:443", "proxy", "192.0.2.1:443"},
+		{"proxied ipv6", "", "", nil, "[2001:db8::1]:443", "proxy", "[2001:db8::1]:443"},
+		{"auth direct", "u", "p", &proxy.Auth{User: "u", Password: "p"}, "127.0.0.1:" + directPort, "direct", ""},
+		{"auth passed to backend", "u", "p", &proxy.Auth{User: "u", Password: "p"}, "a.proxied.test:80", "proxy", "a.proxied.test:80"},
+		{"wrong password", "u", "p", &proxy.Auth{User: "u", Password: "x"}, direct, "", ""},
+		{"no credentials", "u", "p", nil, direct, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, addr := newServer(t, tt.user, tt.pass, echo(t, "proxy"))
+			d, err := proxy.SOCKS5("tcp", addr, tt.auth, &net.Dialer{Timeout: 5 * time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := d.Dial("tcp", tt.target)
+			if tt.want == "" {
+				if err == nil {
+					c.Close()
+					t.Fatal("dial succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if got := roundTrip(t, c); got != tt.want {
+				t.Errorf("routed %s, want %s", got, tt.want)
+			}
+			var wantSeen []string
+			if tt.backend != "" {
+				wantSeen = []string{tt.backend}
+			}
+			if got := b.seen(); fmt.Sprint(got) != fmt.Sprint(wantSeen) {
+				t.Errorf("backend targets = %v, want %v", got, wantSeen)
+			}
+		})
+	}
+}
+
+func TestSOCKSUnsupportedCommand(t *testing.T) {
+	_, addr := newServer(t, "", "", echo(t, "proxy"))
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	// greeting, then BIND to 127.0.0.1:80
+	_, _ = c.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 80})
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(c, reply[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x07 {
+		t.Errorf("reply code = %#x, want 0x07 (command not supported)", reply[1])
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	direct := echo(t, "direct")
+	tests := []struct {
+		name       string
+		user, pass string
+		header     string
+		target     string
+		status     string
+		want       string
+	}{
+		{"direct", "", "", "", direct, "200", "direct"},
+		{"proxied", "", "", "", "www.proxied.test:443", "200", "proxy"},
+		{"default port", "", "", "", "www.proxied.test", "200", "proxy"},
+		{"auth required", "u", "p", "", direct, "407", ""},
+		{"auth ok", "u", "p", "Proxy-Authorization: Basic dTpw\r\n", direct, "200", "direct"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, addr := newServer(t, tt.user, tt.pass, echo(t, "proxy"))
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", tt.target, tt.target, tt.header)
+			br := bufio.NewReader(c)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(resp.Status, tt.status) {
+				t.Fatalf("status = %q, want %s", resp.Status, tt.status)
+			}
+			if tt.want == "" {
+				return
+			}
+			tag, err := br.ReadString('\n')
+			if err != nil || strings.TrimSpace(tag) != tt.want {
+				t.Errorf("routed %q (%v), want %s", tag, err, tt.want)
+			}
+			if tt.want == "proxy" {
+				host := tt.target
+				if !strings.Contains(host, ":") {
+					host += ":443"
+				}
+				if got := b.seen(); len(got) != 1 || got[0] != host {
+					t.Errorf("backend targets = %v, want [%s]", got, host)
+				}
+			}
+		})
+	}
+}
+
+func TestPlainHTTP(t *testing.T) {
+	serve := func(tag string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Proxy-Authorization") != "" || r.Header.Get("Proxy-Connection") != "" {
+				t.Errorf("%s: proxy headers forwarded: %v", tag, r.Header)
+			}
+			io.WriteString(w, tag)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	direct, proxied := serve("direct"), serve("proxy")
+	_, proxiedPort, _ := net.SplitHostPort(strings.TrimPrefix(proxied.URL, "http://"))
+
+	tests := []struct {
+		name       string
+		user, pass string
+		proxyUser  *url.Userinfo
+		url        string
+		status     int
+		want       string
+	}{
+		{"direct", "", "", nil, direct.URL + "/", http.StatusOK, "direct"},
+		{"proxied", "", "", nil, "http://www.proxied.test:" + proxiedPort + "/", http.StatusOK, "proxy"},
+		{"auth required", "u", "p", nil, direct.URL + "/", http.StatusProxyAuthRequired, ""},
+		{"auth ok", "u", "p", url.UserPassword("u", "p"), direct.URL + "/", http.StatusOK, "direct"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := newServer(t, tt.user, tt.pass, strings.TrimPrefix(proxied.URL, "http://"))
+			client := &http.Client{
+				Timeout:   5 * time.Second,
+				Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr, User: tt.proxyUser})},
+			}
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.want != "" && string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
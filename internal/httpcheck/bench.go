@@ -0,0 +1,173 @@
+package httpcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default benchmark targets; "%d" in the download URL is replaced with the
+// payload size.
+const (
+	DefaultBenchDownURL = "https://speed.cloudflare.com/__down?bytes=%d"
+	DefaultBenchUpURL   = "https://speed.cloudflare.com/__up"
+)
+
+// BenchOptions controls a throughput benchmark through the proxy.
+type BenchOptions struct {
+	DownloadURL string
+	UploadURL   string // empty skips the upload test
+	Bytes       int64  // payload per round, default 5 MB
+	Rounds      int    // default 3
+	Timeout     time.Duration
+}
+
+// BenchResult summarizes a benchmark. TTFB is the median over rounds and
+// Jitter the mean difference between consecutive TTFBs (RFC 3550 style).
+type BenchResult struct {
+	DownMbps float64
+	UpMbps   float64
+	TTFB     time.Duration
+	Jitter   time.Duration
+}
+
+// Bench downloads (and optionally uploads) a payload Rounds times through p.
+func Bench(p Proxy, o BenchOptions) (BenchResult, error) {
+	if o.DownloadURL == "" {
+		o.DownloadURL = DefaultBenchDownURL
+	}
+	if o.Bytes <= 0 {
+		o.Bytes = 5_000_000
+	}
+	if o.Rounds <= 0 {
+		o.Rounds = 3
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 30 * time.Second
+	}
+	// a plain replace leaves the URL's own escapes (%2F, %20) alone
+	downURL := strings.Replace(o.DownloadURL, "%d", strconv.FormatInt(o.Bytes, 10), 1)
+
+	d, err := p.dialer()
+	if err != nil {
+		return BenchResult{}, err
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext, Proxy: nil}}
+	defer client.CloseIdleConnections()
+
+	var res BenchResult
+	var ttfbs []time.Duration
+	var downBytes, upBytes int64
+	var downTime, upTime time.Duration
+	for i := 0; i < o.Rounds; i++ {
+		n, ttfb, elapsed, err := download(client, downURL, o.Bytes, o.Timeout)
+		if err != nil {
+			return res, fmt.Errorf("download: %w", err)
+		}
+		ttfbs = append(ttfbs, ttfb)
+		downBytes += n
+		downTime += elapsed
+
+		if o.UploadURL != "" {
+			elapsed, err := upload(client, o.UploadURL, o.Bytes, o.Timeout)
+			if err != nil {
+				return res, fmt.Errorf("upload: %w", err)
+			}
+			upBytes += o.Bytes
+			upTime += elapsed
+		}
+	}
+
+	res.DownMbps = mbps(downBytes, downTime)
+	res.UpMbps = mbps(upBytes, upTime)
+	for i := 1; i < len(ttfbs); i++ {
+		diff := ttfbs[i] - ttfbs[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		res.Jitter += diff
+	}
+	if len(ttfbs) > 1 {
+		res.Jitter /= time.Duration(len(ttfbs) - 1)
+	}
+	sort.Slice(ttfbs, func(i, j int) bool { return ttfbs[i] < ttfbs[j] })
+	res.TTFB = ttfbs[len(ttfbs)/2]
+	return res, nil
+}
+
+// download fetches url and returns the body size, the time to the first
+// response byte, and the transfer time after it.
+func download(client *http.Client, url string, limit int64, timeout time.Duration) (int64, time.Duration, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	var first time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { first = time.Now() },
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return n, 0, 0, err
+	}
+	if first.IsZero() {
+		first = start
+	}
+	return n, first.Sub(start), time.Since(first), nil
+}
+
+// upload POSTs size zero bytes to url and returns the time until the response.
+func upload(client *http.Client, url string, size int64, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, io.LimitReader(zeros{}, size))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return time.Since(start), nil
+}
+
+func mbps(n int64, d time.Duration) float64 {
+	if n == 0 || d <= 0 {
+		return 0
+	}
+	return float64(n*8) / 1e6 / d.Seconds()
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
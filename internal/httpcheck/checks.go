@@ -0,0 +1,363 @@
+package httpcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"masque-plus/internal/logutil"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
+)
+
+// Proxy is the SOCKS5 proxy a check runs through.
+type Proxy struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func (p Proxy) dialer() (proxy.ContextDialer, error) {
+	var auth *proxy.Auth
+	if p.Username != "" && p.Password != "" {
+		auth = &proxy.Auth{User: p.Username, Password: p.Password}
+	}
+	d, err := proxy.SOCKS5("tcp", p.Addr, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("socks5 dialer does not support contexts")
+	}
+	return cd, nil
+}
+
+func (p Proxy) httpClient() (*http.Client, error) {
+	d, err := p.dialer()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &http.Transport{
+		DialContext:       d.DialContext,
+		Proxy:             nil,
+		DisableKeepAlives: true,
+	}}, nil
+}
+
+// Checker verifies one aspect of connectivity through the proxy.
+type Checker interface {
+	Check(ctx context.Context, p Proxy) error
+	String() string
+}
+
+// HTTPCheck GETs URL and checks the status code (Status, or any 2xx when
+// zero) and, if Body is set, that the body matches it.
+type HTTPCheck struct {
+	URL    string
+	Status int
+	Body   *regexp.Regexp
+}
+
+func (c *HTTPCheck) String() string { return "http " + c.URL }
+
+func (c *HTTPCheck) Check(ctx context.Context, p Proxy) error {
+	client, err := p.httpClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if c.Status != 0 && resp.StatusCode != c.Status {
+		return fmt.Errorf("status %d, want %d", resp.StatusCode, c.Status)
+	}
+	if c.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if c.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if !c.Body.Match(body) {
+		return fmt.Errorf("body does not match %q", c.Body.String())
+	}
+	return nil
+}
+
+// WarpCheck returns the classic check: URL must answer 200 with "warp=on".
+func WarpCheck(url string) *HTTPCheck {
+	return &HTTPCheck{URL: url, Status: http.StatusOK, Body: regexp.MustCompile(`(?i)warp=on`)}
+}
+
+// TCPCheck opens a TCP connection to Addr through the proxy.
+type TCPCheck struct {
+	Addr string
+}
+
+func (c *TCPCheck) String() string { return "tcp " + c.Addr }
+
+func (c *TCPCheck) Check(ctx context.Context, p Proxy) error {
+	d, err := p.dialer()
+	if err != nil {
+		return err
+	}
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// DNSCheck sends an A query for Name to Server over UDP, relayed by the
+// proxy (SOCKS5 UDP ASSOCIATE), and expects an answer.
+type DNSCheck struct {
+	Server string
+	Name   string
+}
+
+func (c *DNSCheck) String() string { return "dns " + c.Name + "@" + c.Server }
+
+func (c *DNSCheck) Check(ctx context.Context, p Proxy) error {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(c.Name, ".") + ".")
+	if err != nil {
+		return err
+	}
+	id := uint16(time.Now().UnixNano())
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := q.Pack()
+	if err != nil {
+		return err
+	}
+	raw, err := udpExchange(ctx, p, c.Server, packed)
+	if err != nil {
+		return err
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(raw); err != nil {
+		return err
+	}
+	if m.Header.ID != id {
+		return errors.New("mismatched DNS response id")
+	}
+	if m.Header.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("rcode %s", m.Header.RCode)
+	}
+	return nil
+}
+
+// ThroughputCheck downloads up to Bytes from URL and fails when the rate
+// is below MinKbps.
+type ThroughputCheck struct {
+	URL     string
+	Bytes   int64
+	MinKbps float64
+}
+
+func (c *ThroughputCheck) String() string { return "throughput " + c.URL }
+
+func (c *ThroughputCheck) Check(ctx context.Context, p Proxy) error {
+	client, err := p.httpClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	limit := c.Bytes
+	if limit <= 0 {
+		limit = 1 << 20
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return err
+	}
+	kbps := float64(n*8) / 1000 / time.Since(start).Seconds()
+	if kbps < c.MinKbps {
+		return fmt.Errorf("%.0f kbps, want at least %.0f", kbps, c.MinKbps)
+	}
+	return nil
+}
+
+// Suite runs a list of checks; with Any one passing check is enough,
+// otherwise all must pass.
+type Suite struct {
+	Checks  []Checker
+	Any     bool
+	Timeout time.Duration // per check, default 10s
+}
+
+// Run executes the checks through p and returns nil if the suite passes.
+func (s *Suite) Run(p Proxy) error {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	var errs []error
+	for _, c := range s.Checks {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := c.Check(ctx, p)
+		cancel()
+
+		fields := map[string]string{
+			"check":   c.String(),
+			"bind":    p.Addr,
+			"elapsed": time.Since(start).Round(time.Millisecond).String(),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+			logutil.Warn("check failed", fields)
+			errs = append(errs, fmt.Errorf("%s: %w", c, err))
+			if !s.Any {
+				return errs[0]
+			}
+			continue
+		}
+		logutil.Info("check passed", fields)
+		if s.Any {
+			return nil
+		}
+	}
+	if s.Any && len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// checkOptions lists the options each check kind accepts.
+var checkOptions = map[string][]string{
+	"warp":       nil,
+	"http":       {"status", "body"},
+	"tcp":        nil,
+	"dns":        {"name"},
+	"throughput": {"min", "bytes"},
+}
+
+// ParseCheck parses one check spec: a kind=argument pair optionally
+// followed by space-separated key=value options. An http check's body=
+// comes last and takes the rest of the spec, so the regex may contain
+// spaces. Options the kind does not know are rejected.
+//
+//	warp=https://connectivity.cloudflareclient.com/cdn-cgi/trace
+//	http=https://example.com/ status=204 body=hello world
+//	tcp=example.com:443
+//	dns=1.1.1.1:53 name=example.com
+//	throughput=https://speed.cloudflare.com/__down?bytes=1000000 min=500 bytes=1000000
+func ParseCheck(spec string) (Checker, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, errors.New("empty check")
+	}
+	kind, arg, _ := strings.Cut(fields[0], "=")
+	allowed, known := checkOptions[kind]
+	if !known {
+		return nil, fmt.Errorf("unknown check kind %q (want warp, http, tcp, dns or throughput)", kind)
+	}
+	opts := map[string]string{}
+	if kind == "http" {
+		head, body, hasBody := strings.Cut(spec, " body=")
+		if hasBody {
+			opts["body"] = body
+			fields = strings.Fields(head)
+		}
+	}
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("check %q: option %q is not key=value", spec, f)
+		}
+		if !slices.Contains(allowed, k) {
+			return nil, fmt.Errorf("check %q: %s checks take no option %q", spec, kind, k)
+		}
+		opts[k] = v
+	}
+	if arg == "" {
+		return nil, fmt.Errorf("check %q: missing argument", spec)
+	}
+
+	switch kind {
+	case "warp":
+		return WarpCheck(arg), nil
+	case "http":
+		c := &HTTPCheck{URL: arg}
+		if v, ok := opts["status"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("check %q: invalid status %q", spec, v)
+			}
+			c.Status = n
+		}
+		if v, ok := opts["body"]; ok {
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, fmt.Errorf("check %q: %v", spec, err)
+			}
+			c.Body = re
+		}
+		return c, nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(arg); err != nil {
+			return nil, fmt.Errorf("check %q: %v", spec, err)
+		}
+		return &TCPCheck{Addr: arg}, nil
+	case "dns":
+		if _, _, err := net.SplitHostPort(arg); err != nil {
+			arg = net.JoinHostPort(arg, "53")
+		}
+		name := opts["name"]
+		if name == "" {
+			name = "cloudflare.com"
+		}
+		return &DNSCheck{Server: arg, Name: name}, nil
+	case "throughput":
+		c := &ThroughputCheck{URL: arg}
+		if v, ok := opts["min"]; ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("check %q: invalid min %q", spec, v)
+			}
+			c.MinKbps = f
+		}
+		if v, ok := opts["bytes"]; ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("check %q: invalid bytes %q", spec, v)
+			}
+			c.Bytes = n
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown check kind %q", kind)
+}
@@ -0,0 +1,64 @@
+package httpcheck
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCheck(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string // String() of the check
+		body    string // HTTPCheck body regex
+		status  int
+		wantErr string
+	}{
+		{spec: "http=https://example.com/", want: "http https://example.com/"},
+		{spec: "http=https://example.com/ status=204", want: "http https://example.com/", status: 204},
+		{spec: "http=https://example.com/ body=ok", want: "http https://example.com/", body: "ok"},
+		{spec: "http=https://example.com/ status=200 body=Example Domain", want: "http https://example.com/", status: 200, body: "Example Domain"},
+		{spec: "http=https://example.com/ body=a  b=c", want: "http https://example.com/", body: "a  b=c"},
+		{spec: "tcp=example.com:443", want: "tcp example.com:443"},
+		{spec: "dns=1.1.1.1", want: "dns cloudflare.com@1.1.1.1:53"},
+		{spec: "dns=1.1.1.1:53 name=example.com", want: "dns example.com@1.1.1.1:53"},
+		{spec: "throughput=https://speed.example/ min=500", want: "throughput https://speed.example/"},
+		{spec: "", wantErr: "empty check"},
+		{spec: "http=", wantErr: "missing argument"},
+		{spec: "http=https://example.com/ status=ok", wantErr: "invalid status"},
+		{spec: "http=https://example.com/ body=(", wantErr: "missing closing )"},
+		{spec: "http=https://example.com/ loose", wantErr: "not key=value"},
+		{spec: "tcp=example.com", wantErr: "missing port"},
+		{spec: "ping=1.1.1.1", wantErr: "unknown check kind"},
+		{spec: "http=https://example.com/ statsu=200", wantErr: `take no option "statsu"`},
+		{spec: "tcp=example.com:443 name=x", wantErr: `take no option "name"`},
+		{spec: "dns=1.1.1.1 body=x y", wantErr: `take no option "body"`},
+		{spec: "warp=https://example.com/ status=200", wantErr: `take no option "status"`},
+		{spec: "throughput=https://speed.example/ min=500 bytes=1000", want: "throughput https://speed.example/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			c, err := ParseCheck(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.String() != tt.want {
+				t.Errorf("check = %q, want %q", c, tt.want)
+			}
+			if h, ok := c.(*HTTPCheck); ok {
+				var body string
+				if h.Body != nil {
+					body = h.Body.String()
+				}
+				if body != tt.body || h.Status != tt.status {
+					t.Errorf("body %q status %d, want %q %d", body, h.Status, tt.body, tt.status)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package httpcheck
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// udpExchange sends one datagram to dst through the SOCKS5 proxy using
+// UDP ASSOCIATE (RFC 1928 section 7) and returns the first reply.
+func udpExchange(ctx context.Context, p Proxy, dst string, payload []byte) ([]byte, error) {
+	var d net.Dialer
+	ctrl, err := d.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer ctrl.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = ctrl.SetDeadline(dl)
+	}
+
+	if err := socksAuth(ctrl, p); err != nil {
+		return nil, err
+	}
+	// UDP ASSOCIATE; we don't know our source address, so send zeros.
+	if _, err := ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	relay, err := readReply(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(p.Addr)
+		relay.IP = net.ParseIP(host)
+	}
+
+	hdr, err := udpHeader(dst)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.DialContext(ctx, "udp", relay.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(append(hdr, payload...)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return stripUDPHeader(buf[:n])
+}
+
+func socksAuth(rw io.ReadWriter, p Proxy) error {
+	methods := []byte{5, 1, 0}
+	if p.Username != "" && p.Password != "" {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err := rw.Write(methods); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(rw, resp[:]); err != nil {
+		return err
+	}
+	switch resp[1] {
+	case 0:
+		return nil
+	case 2:
+		msg := []byte{1, byte(len(p.Username))}
+		msg = append(msg, p.Username...)
+		msg = append(msg, byte(len(p.Password)))
+		msg = append(msg, p.Password...)
+		if _, err := rw.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errors.New("socks5 authentication failed")
+		}
+		return nil
+	}
+	return errors.New("socks5: no acceptable authentication method")
+}
+
+func readReply(r io.Reader) (*net.UDPAddr, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if h[1] != 0 {
+		return nil, fmt.Errorf("socks5 UDP associate rejected (code %d)", h[1])
+	}
+	var ip net.IP
+	switch h[3] {
+	case 1:
+		ip = make(net.IP, 4)
+	case 4:
+		ip = make(net.IP, 16)
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		ips, err := net.LookupIP(string(name))
+		if err != nil || len(ips) == 0 {
+			return nil, fmt.Errorf("socks5 relay %q: cannot resolve", name)
+		}
+		var port [2]byte
+		if _, err := io.ReadFull(r, port[:]); err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ips[0], Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+	default:
+		return nil, fmt.Errorf("socks5: unknown address type %d", h[3])
+	}
+	if _, err := io.ReadFull(r, ip); err != nil {
+		return nil, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
+
+func udpHeader(dst string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(dst)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	hdr := []byte{0, 0, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		hdr = append(hdr, 3, byte(len(host)))
+		hdr = append(hdr, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		hdr = append(hdr, 1)
+		hdr = append(hdr, ip4...)
+	} else {
+		hdr = append(hdr, 4)
+		hdr = append(hdr, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(hdr, uint16(port)), nil
+}
+
+func stripUDPHeader(b []byte) ([]byte, error) {
+	if len(b) < 4 {
+		return nil, errors.New("short socks5 UDP packet")
+	}
+	off := 4
+	switch b[3] {
+	case 1:
+		off += 4
+	case 4:
+		off += 16
+	case 3:
+		if len(b) < 5 {
+			return nil, errors.New("short socks5 UDP packet")
+		}
+		off += 1 + int(b[4])
+	default:
+		return nil, fmt.Errorf("socks5: unknown address type %d", b[3])
+	}
+	off += 2
+	if len(b) < off {
+		return nil, errors.New("short socks5 UDP packet")
+	}
+	return b[off:], nil
+}
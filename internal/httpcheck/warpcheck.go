@@ -10,8 +10,6 @@ import (
 	"time"
 
 	"masque-plus/internal/logutil"
-
-	"golang.org/x/net/proxy"
 )
 
 // ResultStatus is the final outcome of the check.
@@ -27,6 +25,12 @@ const (
 // CheckWarpOverSocks dials through a SOCKS5 proxy at `bind`, GETs `url`, and looks for "warp=on" in the body.
 // It logs structured messages via logutil and returns a ResultStatus and error.
 func CheckWarpOverSocks(bind, url string, timeout time.Duration) (ResultStatus, error) {
+	return CheckWarp(Proxy{Addr: bind}, url, timeout)
+}
+
+// CheckWarp is CheckWarpOverSocks for a proxy that may require authentication.
+func CheckWarp(p Proxy, url string, timeout time.Duration) (ResultStatus, error) {
+	bind := p.Addr
 	start := time.Now()
 
 	logutil.Info("warp check start", map[string]string{
@@ -35,7 +39,7 @@ func CheckWarpOverSocks(bind, url string, timeout time.Duration) (ResultStatus,
 		"timeout": timeout.String(),
 	})
 
-	dialer, err := proxy.SOCKS5("tcp", bind, nil, proxy.Direct)
+	dialer, err := p.dialer()
 	if err != nil {
 		logutil.Error("socks5 dialer error", map[string]string{
 			"bind":    bind,
@@ -47,7 +51,7 @@ func CheckWarpOverSocks(bind, url string, timeout time.Duration) (ResultStatus,
 
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
-			return dialer.Dial(network, address)
+			return dialer.DialContext(ctx, network, address)
 		},
 		TLSHandshakeTimeout: timeout,
 		Proxy:               nil, // disable env proxy
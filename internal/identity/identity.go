@@ -0,0 +1,104 @@
+package identity
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultDir is where named identities (usque config files) are kept.
+const DefaultDir = "./identities"
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Identity is one registered usque account.
+type Identity struct {
+	Name    string
+	Path    string
+	ModTime time.Time
+}
+
+// Pool is a directory of "<name>.json" usque configs.
+type Pool struct {
+	Dir string
+}
+
+// ValidateName rejects names that would escape the pool directory.
+func ValidateName(name string) error {
+	if !namePattern.MatchString(name) || strings.HasSuffix(name, ".json") {
+		return fmt.Errorf("invalid identity name %q (letters, digits, '.', '_', '-')", name)
+	}
+	return nil
+}
+
+// Path returns the config file for name, without checking that it exists.
+func (p Pool) Path(name string) string {
+	return filepath.Join(p.Dir, name+".json")
+}
+
+// Exists reports whether an identity with that name has been registered.
+func (p Pool) Exists(name string) bool {
+	_, err := os.Stat(p.Path(name))
+	return err == nil
+}
+
+// List returns all identities sorted by name. A missing directory is an empty pool.
+func (p Pool) List() ([]Identity, error) {
+	entries, err := os.ReadDir(p.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []Identity
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".json")
+		if ValidateName(name) != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, Identity{Name: name, Path: filepath.Join(p.Dir, e.Name()), ModTime: info.ModTime()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Delete removes a named identity.
+func (p Pool) Delete(name string) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	if !p.Exists(name) {
+		return fmt.Errorf("identity %q not found", name)
+	}
+	return os.Remove(p.Path(name))
+}
+
+// Next returns the identity following after (wrapping around). If after is
+// empty or unknown, the first identity is returned.
+func (p Pool) Next(after string) (Identity, error) {
+	ids, err := p.List()
+	if err != nil {
+		return Identity{}, err
+	}
+	if len(ids) == 0 {
+		return Identity{}, fmt.Errorf("no identities in %s", p.Dir)
+	}
+	for i, id := range ids {
+		if id.Name == after {
+			return ids[(i+1)%len(ids)], nil
+		}
+	}
+	return ids[0], nil
+}
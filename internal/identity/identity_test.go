@@ -0,0 +1,162 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"work", true},
+		{"home-2", true},
+		{"a.b_c", true},
+		{strings.Repeat("a", 64), true},
+		{"", false},
+		{"..", false},
+		{".", false},
+		{".hidden", false},
+		{"../escape", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"/abs", false},
+		{"x.json", false},
+		{"has space", false},
+		{strings.Repeat("a", 65), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateName(tt.name); (err == nil) != tt.ok {
+				t.Errorf("ValidateName(%q) = %v, want ok %v", tt.name, err, tt.ok)
+			}
+		})
+	}
+}
+
+// newPool creates a pool holding the given files (names relative to its
+// directory; a trailing slash makes a directory).
+func newPool(t *testing.T, files ...string) Pool {
+	t.Helper()
+	dir := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		if strings.HasSuffix(f, "/") {
+			if err := os.MkdirAll(path, 0700); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.WriteFile(path, []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Pool{Dir: dir}
+}
+
+func names(ids []Identity) string {
+	var out []string
+	for _, id := range ids {
+		out = append(out, id.Name)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"empty", nil, ""},
+		{"sorted", []string{"work.json", "home.json", "alt.json"}, "alt,home,work"},
+		{"skips other files", []string{"work.json", "notes.txt", "work.json.bak", "dir.json/", ".hidden.json"}, "work"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPool(t, tt.files...)
+			ids, err := p.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(ids); got != tt.want {
+				t.Errorf("List = %q, want %q", got, tt.want)
+			}
+			for _, id := range ids {
+				if id.Path != p.Path(id.Name) || id.ModTime.IsZero() {
+					t.Errorf("identity %+v", id)
+				}
+			}
+		})
+	}
+
+	ids, err := Pool{Dir: filepath.Join(t.TempDir(), "missing")}.List()
+	if err != nil || len(ids) != 0 {
+		t.Errorf("List of a missing dir = %v, %v, want an empty pool", ids, err)
+	}
+}
+
+func TestNext(t *testing.T) {
+	p := newPool(t, "a.json", "b.json", "c.json")
+	tests := []struct {
+		after string
+		want  string
+	}{
+		{"a", "b"},
+		{"b", "c"},
+		{"c", "a"}, // wraps around
+		{"", "a"},
+		{"gone", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.after, func(t *testing.T) {
+			id, err := p.Next(tt.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Name != tt.want {
+				t.Errorf("Next(%q) = %q, want %q", tt.after, id.Name, tt.want)
+			}
+		})
+	}
+
+	single := newPool(t, "only.json")
+	if id, err := single.Next("only"); err != nil || id.Name != "only" {
+		t.Errorf("Next in a pool of one = %q, %v", id.Name, err)
+	}
+	if _, err := newPool(t).Next(""); err == nil {
+		t.Error("Next in an empty pool succeeded")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name    string
+		del     string
+		wantErr bool
+		left    string
+	}{
+		{"existing", "b", false, "a"},
+		{"missing", "zzz", true, "a,b"},
+		{"invalid name", "../a", true, "a,b"},
+		{"empty name", "", true, "a,b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPool(t, "a.json", "b.json")
+			if err := p.Delete(tt.del); (err != nil) != tt.wantErr {
+				t.Errorf("Delete(%q) = %v, wantErr %v", tt.del, err, tt.wantErr)
+			}
+			ids, _ := p.List()
+			if got := names(ids); got != tt.left {
+				t.Errorf("left %q, want %q", got, tt.left)
+			}
+			if p.Exists(tt.del) && !tt.wantErr {
+				t.Errorf("%q still exists", tt.del)
+			}
+		})
+	}
+}
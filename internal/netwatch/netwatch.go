@@ -0,0 +1,98 @@
+// Package netwatch reports changes of the local network (interfaces,
+// addresses, routes), e.g. when a laptop joins another Wi-Fi network.
+package netwatch
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"masque-plus/internal/logutil"
+)
+
+// pollInterval is used where no change notification API is available.
+const pollInterval = 5 * time.Second
+
+// Watch sends on the returned channel after the local network changed.
+// Bursts of changes are coalesced: an event is sent once no further change
+// was seen for debounce. The channel is closed when stop is closed.
+func Watch(debounce time.Duration, stop <-chan struct{}) <-chan struct{} {
+	raw := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case raw <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		if err := watchOS(notify, stop); err != nil {
+			logutil.Warn("network change notifications unavailable; polling", map[string]string{"error": err.Error()})
+			poll(notify, stop)
+		}
+	}()
+
+	out := make(chan struct{}, 1)
+	go func() {
+		defer close(out)
+		var timer *time.Timer
+		var fire <-chan time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case <-raw:
+				if timer == nil {
+					timer = time.NewTimer(debounce)
+				} else {
+					timer.Reset(debounce)
+				}
+				fire = timer.C
+			case <-fire:
+				fire = nil
+				select {
+				case out <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// poll compares an interface/address fingerprint every pollInterval.
+func poll(notify func(), stop <-chan struct{}) {
+	last := fingerprint()
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if fp := fingerprint(); fp != last {
+				last = fp
+				notify()
+			}
+		}
+	}
+}
+
+func fingerprint() string {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var parts []string
+	for _, ifc := range ifs {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			parts = append(parts, ifc.Name+"="+a.String())
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
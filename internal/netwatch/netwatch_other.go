@@ -0,0 +1,10 @@
+//go:build !linux
+
+package netwatch
+
+import "errors"
+
+// watchOS is not implemented here; Watch falls back to polling.
+func watchOS(notify func(), stop <-chan struct{}) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,155 @@
+package pac
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"masque-plus/internal/logutil"
+	"masque-plus/internal/router"
+)
+
+// ParseBypass turns a list of domains and CIDRs into direct rules.
+// Entries that parse as a CIDR become cidr rules; everything else is
+// treated as a domain suffix.
+func ParseBypass(entries []string) ([]router.Rule, error) {
+	var out []router.Rule
+	for _, e := range entries {
+		kind := router.KindDomainSuffix
+		if _, _, err := net.ParseCIDR(e); err == nil {
+			kind = router.KindCIDR
+		}
+		r, err := router.NewRule(kind, e, router.ActionDirect)
+		if err != nil {
+			return nil, fmt.Errorf("bypass %q: %w", e, err)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// Generate renders a PAC script. Rules are evaluated in order, matching
+// router semantics; final applies when nothing matches. proxyAddr is the
+// "host:port" of the SOCKS proxy browsers should use.
+func Generate(rules []router.Rule, final router.Action, proxyAddr string) string {
+	// only SOCKS5: a bare "SOCKS" means SOCKS4, which the front-end
+	// doesn't speak
+	proxyRet := "SOCKS5 " + proxyAddr
+	ret := func(a router.Action) string {
+		if a == router.ActionDirect {
+			return "DIRECT"
+		}
+		return proxyRet
+	}
+
+	var b strings.Builder
+	b.WriteString("// generated by masque-plus\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("    host = host.toLowerCase();\n")
+	b.WriteString("    var ip = null;\n")
+	b.WriteString("    function addr() {\n")
+	b.WriteString("        if (ip === null) { ip = dnsResolve(host) || \"\"; }\n")
+	b.WriteString("        return ip;\n")
+	b.WriteString("    }\n")
+	if hasCIDR6(rules) {
+		// isInNetEx wants an address, so test every address of host;
+		// both functions only exist in some browsers (Chrome, IE).
+		b.WriteString("    var ips = null;\n")
+		b.WriteString("    function inNetEx(cidr) {\n")
+		b.WriteString("        if (typeof isInNetEx !== \"function\" || typeof dnsResolveEx !== \"function\") return false;\n")
+		b.WriteString("        if (ips === null) { ips = (dnsResolveEx(host) || \"\").split(\";\"); }\n")
+		b.WriteString("        for (var i = 0; i < ips.length; i++) {\n")
+		b.WriteString("            if (ips[i] !== \"\" && isInNetEx(ips[i], cidr)) return true;\n")
+		b.WriteString("        }\n")
+		b.WriteString("        return false;\n")
+		b.WriteString("    }\n")
+	}
+
+	for _, r := range rules {
+		act := ret(r.Action)
+		switch r.Kind {
+		case router.KindDomainSuffix:
+			fmt.Fprintf(&b, "    if (host === %q || dnsDomainIs(host, %q)) return %q;\n", r.Value, "."+r.Value, act)
+		case router.KindDomainKeyword:
+			fmt.Fprintf(&b, "    if (host.indexOf(%q) !== -1) return %q;\n", r.Value, act)
+		case router.KindCIDR:
+			n := r.IPNet()
+			if n.IP.To4() != nil {
+				fmt.Fprintf(&b, "    if (isInNet(addr(), %q, %q)) return %q;\n", n.IP.String(), net.IP(n.Mask).String(), act)
+			} else {
+				fmt.Fprintf(&b, "    if (inNetEx(%q)) return %q;\n", n.String(), act)
+			}
+		default:
+			// geoip rules need the database and cannot be expressed in PAC
+			fmt.Fprintf(&b, "    // skipped %s,%s\n", r.Kind, r.Value)
+		}
+	}
+
+	fmt.Fprintf(&b, "    return %q;\n", ret(final))
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func hasCIDR6(rules []router.Rule) bool {
+	for _, r := range rules {
+		if r.Kind == router.KindCIDR && r.IPNet().IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Server serves the PAC file at /proxy.pac and /wpad.dat.
+type Server struct {
+	Listen string
+	Proxy  string // SOCKS bind ("IP:Port") advertised to browsers
+	Bypass []router.Rule
+	Router *router.Router // optional; its rules follow the bypass list
+}
+
+// ListenAndServe blocks serving the PAC file.
+func (s *Server) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", s.handle)
+	mux.HandleFunc("/wpad.dat", s.handle)
+
+	logutil.Info("serving PAC file", map[string]string{
+		"address": s.Listen,
+		"url":     fmt.Sprintf("http://%s/proxy.pac", s.Listen),
+		"proxy":   s.Proxy,
+	})
+	return http.ListenAndServe(s.Listen, mux)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	rules := append([]router.Rule{}, s.Bypass...)
+	final := router.ActionProxy
+	if s.Router != nil {
+		rs := s.Router.Rules()
+		rules = append(rules, rs.Rules...)
+		final = rs.Final
+	}
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(Generate(rules, final, s.proxyFor(r))))
+}
+
+// proxyFor replaces an unspecified bind host (0.0.0.0 / ::) with the host
+// the browser used to reach the PAC server, since that one is reachable.
+func (s *Server) proxyFor(r *http.Request) string {
+	host, port, err := net.SplitHostPort(s.Proxy)
+	if err != nil {
+		return s.Proxy
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsUnspecified() {
+		return s.Proxy
+	}
+	reqHost, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		reqHost = r.Host
+	}
+	return net.JoinHostPort(reqHost, port)
+}
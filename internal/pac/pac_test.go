@@ -0,0 +1,103 @@
+package pac
+
+import (
+	"strings"
+	"testing"
+
+	"masque-plus/internal/router"
+)
+
+func mustRule(t *testing.T, kind, value string, act router.Action) router.Rule {
+	t.Helper()
+	r, err := router.NewRule(kind, value, act)
+	if err != nil {
+		t.Fatalf("NewRule(%s, %s): %v", kind, value, err)
+	}
+	return r
+}
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []router.Rule
+		final   router.Action
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "final proxy is SOCKS5 only",
+			final:   router.ActionProxy,
+			want:    []string{`return "SOCKS5 127.0.0.1:1080";`},
+			notWant: []string{"SOCKS 127.0.0.1:1080", "inNetEx"},
+		},
+		{
+			name:  "final direct",
+			final: router.ActionDirect,
+			want:  []string{`return "DIRECT";`},
+		},
+		{
+			name:  "domain suffix",
+			rules: []router.Rule{mustRule(t, router.KindDomainSuffix, "example.ir", router.ActionDirect)},
+			final: router.ActionProxy,
+			want:  []string{`if (host === "example.ir" || dnsDomainIs(host, ".example.ir")) return "DIRECT";`},
+		},
+		{
+			name:  "domain keyword",
+			rules: []router.Rule{mustRule(t, router.KindDomainKeyword, "google", router.ActionProxy)},
+			final: router.ActionDirect,
+			want:  []string{`if (host.indexOf("google") !== -1) return "SOCKS5 127.0.0.1:1080";`},
+		},
+		{
+			name:    "IPv4 CIDR",
+			rules:   []router.Rule{mustRule(t, router.KindCIDR, "192.168.0.0/16", router.ActionDirect)},
+			final:   router.ActionProxy,
+			want:    []string{`if (isInNet(addr(), "192.168.0.0", "255.255.0.0")) return "DIRECT";`},
+			notWant: []string{"inNetEx"},
+		},
+		{
+			name:  "IPv6 CIDR tests resolved addresses",
+			rules: []router.Rule{mustRule(t, router.KindCIDR, "2001:db8::/32", router.ActionDirect)},
+			final: router.ActionProxy,
+			want: []string{
+				`dnsResolveEx(host)`,
+				`isInNetEx(ips[i], cidr)`,
+				`if (inNetEx("2001:db8::/32")) return "DIRECT";`,
+			},
+			notWant: []string{"isInNetEx(host"},
+		},
+		{
+			name:  "geoip is skipped",
+			rules: []router.Rule{mustRule(t, router.KindGeoIP, "IR", router.ActionDirect)},
+			final: router.ActionProxy,
+			want:  []string{"// skipped geoip,IR"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Generate(tt.rules, tt.final, "127.0.0.1:1080")
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("missing %q in:\n%s", w, got)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(got, w) {
+					t.Errorf("unexpected %q in:\n%s", w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBypass(t *testing.T) {
+	rules, err := ParseBypass([]string{"example.ir", "10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{router.KindDomainSuffix, router.KindCIDR, router.KindCIDR}
+	for i, r := range rules {
+		if r.Kind != want[i] || r.Action != router.ActionDirect {
+			t.Errorf("rule %d = %s/%s, want %s/direct", i, r.Kind, r.Action, want[i])
+		}
+	}
+}
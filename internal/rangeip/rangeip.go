@@ -2,60 +2,103 @@ package rangeip
 
 import (
 	"crypto/rand"
-	"encoding/binary"
 	"math/big"
+	mrand "math/rand"
 	"net"
 )
 
-// ExpandCIDR returns n random IPs within the given CIDR.
+// ExpandCIDR returns n distinct random IPs within the given CIDR (fewer if
+// the range is smaller).
 func ExpandCIDR(cidr string, n int) ([]net.IP, error) {
+	return SampleCIDR(cidr, n, 0, nil)
+}
+
+// SampleCIDR returns up to n distinct random IPs within cidr, spread over
+// sub-prefixes of length stratum (e.g. 64 for IPv6, 28 for IPv4): when there
+// are fewer sub-prefixes than n every one is used round-robin, otherwise n
+// distinct sub-prefixes are picked at random. stratum <= the CIDR's own
+// prefix length disables stratification. rng makes the result reproducible;
+// nil uses crypto/rand. IPv4 network and broadcast addresses are skipped.
+func SampleCIDR(cidr string, n int, stratum int, rng *mrand.Rand) ([]net.IP, error) {
 	_, ipnet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return nil, err
 	}
-	res := make([]net.IP, 0, n)
-	for len(res) < n {
-		ip := randomIPInNet(ipnet)
-		if ip == nil {
+	ones, bits := ipnet.Mask.Size()
+	ipLen := bits / 8
+	base := new(big.Int).SetBytes(ipnet.IP.To16()[16-ipLen:])
+
+	hostBits := bits - ones
+	if stratum <= ones || stratum > bits {
+		stratum = ones
+	}
+	strataBits := stratum - ones
+	subBits := bits - stratum
+
+	// number of usable addresses caps the sample
+	usable := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+	skipEdges := ipLen == net.IPv4len && hostBits >= 2
+	if skipEdges {
+		usable.Sub(usable, big.NewInt(2))
+	}
+	if usable.IsInt64() && int64(n) > usable.Int64() {
+		n = int(usable.Int64())
+	}
+
+	numStrata := new(big.Int).Lsh(big.NewInt(1), uint(strataBits))
+	subSize := new(big.Int).Lsh(big.NewInt(1), uint(subBits))
+	last := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(hostBits)), big.NewInt(1))
+
+	roundRobin := numStrata.IsInt64() && numStrata.Int64() <= int64(n)
+	usedStrata := map[string]bool{}
+	seen := map[string]bool{}
+	out := make([]net.IP, 0, n)
+
+	for i, misses := 0, 0; len(out) < n && misses < 16*n+64; i++ {
+		var s *big.Int
+		if roundRobin {
+			s = big.NewInt(int64(i) % numStrata.Int64())
+		} else {
+			s = randBelow(numStrata, rng)
+			if usedStrata[s.String()] {
+				misses++
+				continue
+			}
+		}
+
+		off := new(big.Int).Lsh(s, uint(subBits))
+		off.Add(off, randBelow(subSize, rng))
+		if skipEdges && (off.Sign() == 0 || off.Cmp(last) == 0) {
+			misses++
 			continue
 		}
-		res = append(res, ip)
-	}
-	return res, nil
-}
 
-func randomIPInNet(ipnet *net.IPNet) net.IP {
-	base := ipnet.IP
-	if base.To4() != nil {
-		mask := binary.BigEndian.Uint32(ipnet.Mask)
-		start := binary.BigEndian.Uint32(base.To4()) & mask
-		size := ^mask
-		if size <= 2 {
-			b := make(net.IP, 4)
-			copy(b, base.To4())
-			return b
+		ip := toIP(new(big.Int).Add(base, off), ipLen)
+		key := ip.String()
+		if seen[key] {
+			misses++
+			continue
 		}
-		max := int64(size - 1)
-		idx, _ := rand.Int(rand.Reader, big.NewInt(max))
-		val := start + 1 + uint32(idx.Int64())
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, val)
-		return net.IP(buf)
-	}
-	ones, _ := ipnet.Mask.Size()
-	width := 128 - ones
-	if width <= 0 {
-		return base
+		seen[key] = true
+		if !roundRobin {
+			usedStrata[s.String()] = true
+		}
+		out = append(out, ip)
 	}
-	max := new(big.Int).Lsh(big.NewInt(1), uint(width))
-	idx, _ := rand.Int(rand.Reader, max)
-	baseInt := new(big.Int).SetBytes(base)
-	cand := new(big.Int).Add(baseInt, idx)
-	b := cand.Bytes()
-	if len(b) < 16 {
-		p := make([]byte, 16)
-		copy(p[16-len(b):], b)
-		b = p
+	return out, nil
+}
+
+func randBelow(max *big.Int, rng *mrand.Rand) *big.Int {
+	if rng != nil {
+		return new(big.Int).Rand(rng, max)
 	}
-	return net.IP(b)
+	v, _ := rand.Int(rand.Reader, max)
+	return v
+}
+
+func toIP(v *big.Int, ipLen int) net.IP {
+	b := v.Bytes()
+	ip := make(net.IP, ipLen)
+	copy(ip[ipLen-len(b):], b)
+	return ip
 }
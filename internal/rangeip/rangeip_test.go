@@ -0,0 +1,77 @@
+package rangeip
+
+import (
+	mrand "math/rand"
+	"net"
+	"testing"
+)
+
+func TestSampleCIDR(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidr    string
+		n       int
+		stratum int
+		want    int // addresses returned
+		strata  int // distinct /stratum prefixes among them, 0 to skip
+	}{
+		{"v4 capped by usable hosts", "10.0.0.0/30", 10, 0, 2, 0},
+		{"v4 single host", "10.0.0.7/32", 3, 0, 1, 0},
+		{"v4 point to point", "10.0.0.0/31", 3, 0, 2, 0},
+		{"v4 spread over /28", "162.159.192.0/24", 16, 28, 16, 16},
+		{"v4 round robin when n exceeds strata", "162.159.192.0/24", 32, 28, 32, 16},
+		{"v6 spread over /64", "2606:4700:d0::/48", 8, 64, 8, 8},
+		{"stratum above host bits disables it", "10.0.0.0/24", 5, 40, 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ipnet, _ := net.ParseCIDR(tt.cidr)
+			ips, err := SampleCIDR(tt.cidr, tt.n, tt.stratum, mrand.New(mrand.NewSource(1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != tt.want {
+				t.Fatalf("got %d addresses, want %d: %v", len(ips), tt.want, ips)
+			}
+			ones, bits := ipnet.Mask.Size()
+			seen := map[string]bool{}
+			strata := map[string]bool{}
+			for _, ip := range ips {
+				if !ipnet.Contains(ip) {
+					t.Errorf("%s outside %s", ip, tt.cidr)
+				}
+				if seen[ip.String()] {
+					t.Errorf("%s returned twice", ip)
+				}
+				seen[ip.String()] = true
+				if v4 := ip.To4(); v4 != nil && bits-ones >= 2 {
+					if ip.Equal(ipnet.IP) || v4[3] == ipnet.IP.To4()[3]|^ipnet.Mask[3] {
+						t.Errorf("%s is the network or broadcast address", ip)
+					}
+				}
+				if tt.stratum > 0 {
+					strata[ip.Mask(net.CIDRMask(tt.stratum, bits)).String()] = true
+				}
+			}
+			if tt.strata > 0 && len(strata) != tt.strata {
+				t.Errorf("addresses span %d /%d prefixes, want %d", len(strata), tt.stratum, tt.strata)
+			}
+		})
+	}
+}
+
+func TestSampleCIDRReproducible(t *testing.T) {
+	a, _ := SampleCIDR("2606:4700:d0::/48", 4, 64, mrand.New(mrand.NewSource(42)))
+	b, _ := SampleCIDR("2606:4700:d0::/48", 4, 64, mrand.New(mrand.NewSource(42)))
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			t.Fatalf("same seed gave %v and %v", a, b)
+		}
+	}
+}
+
+func TestSampleCIDRInvalid(t *testing.T) {
+	if _, err := SampleCIDR("10.0.0.0/33", 1, 0, nil); err == nil {
+		t.Error("want error for an invalid CIDR")
+	}
+}
@@ -0,0 +1,248 @@
+package register
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"masque-plus/internal/logutil"
+	"masque-plus/internal/usqueconfig"
+)
+
+// DefaultAPI is the registration API base URL (including the API version).
+const DefaultAPI = "https://api.cloudflareclient.com/v0a4471"
+
+// headers sent by the official Android client; the API rejects unknown clients.
+var apiHeaders = map[string]string{
+	"User-Agent":        "WARP for Android",
+	"CF-Client-Version": "a-6.35-4471",
+	"Content-Type":      "application/json; charset=UTF-8",
+}
+
+// NativeOptions controls a registration done without the usque binary.
+type NativeOptions struct {
+	BaseURL    string // defaults to DefaultAPI; override to test against a stub
+	ConfigFile string
+	DeviceName string
+	Model      string
+	Locale     string
+
+	AcceptTOS bool
+	Timeout   time.Duration // per attempt
+	Retries   int
+	Backoff   time.Duration
+}
+
+type regRequest struct {
+	Key       string `json:"key"`
+	InstallID string `json:"install_id"`
+	FcmToken  string `json:"fcm_token"`
+	Tos       string `json:"tos"`
+	Model     string `json:"model"`
+	Serial    string `json:"serial_number"`
+	Locale    string `json:"locale"`
+}
+
+type enrollRequest struct {
+	Key        string `json:"key"`
+	KeyType    string `json:"key_type"`
+	TunnelType string `json:"tunnel_type"`
+	Name       string `json:"name,omitempty"`
+}
+
+type accountData struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Account struct {
+		License string `json:"license"`
+	} `json:"account"`
+	Config struct {
+		Peers []struct {
+			PublicKey string `json:"public_key"`
+			Endpoint  struct {
+				V4 string `json:"v4"`
+				V6 string `json:"v6"`
+			} `json:"endpoint"`
+		} `json:"peers"`
+		Interface struct {
+			Addresses struct {
+				V4 string `json:"v4"`
+				V6 string `json:"v6"`
+			} `json:"addresses"`
+		} `json:"interface"`
+	} `json:"config"`
+}
+
+// RunNative registers a device directly against the API, enrolls a fresh
+// P-256 key for MASQUE and writes a usque-compatible config file.
+func RunNative(o NativeOptions) error {
+	if o.BaseURL == "" {
+		o.BaseURL = DefaultAPI
+	}
+	o.BaseURL = strings.TrimRight(o.BaseURL, "/")
+	if o.DeviceName == "" {
+		o.DeviceName = "masque-plus"
+	}
+	if o.Model == "" {
+		o.Model = "PC"
+	}
+	if o.Locale == "" {
+		o.Locale = "en_US"
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Minute
+	}
+
+	if !o.AcceptTOS && askUser("You must accept the Cloudflare terms of service (https://www.cloudflare.com/application/terms/) to continue. Do you accept? (y/n):") != "y" {
+		return ErrTOSNotAccepted
+	}
+
+	return retry(o.Retries, o.Backoff, func() error { return nativeOnce(o) })
+}
+
+func nativeOnce(o NativeOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+	client := &http.Client{}
+
+	// The initial registration is for a WireGuard device; MASQUE needs a
+	// second step that swaps in an ECDSA key.
+	wgKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	installID := randomHex(11)
+	reg := regRequest{
+		Key:       base64.StdEncoding.EncodeToString(wgKey.PublicKey().Bytes()),
+		InstallID: installID,
+		FcmToken:  installID + ":APA91b" + randomHex(67),
+		Tos:       time.Now().Format(time.RFC3339Nano),
+		Model:     o.Model,
+		Serial:    randomHex(8),
+		Locale:    o.Locale,
+	}
+	var acc accountData
+	if err := apiCall(ctx, client, http.MethodPost, o.BaseURL+"/reg", "", reg, &acc); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+	if acc.ID == "" || acc.Token == "" {
+		return errors.New("register: response without id/token")
+	}
+	logutil.Info("device registered", map[string]string{"id": acc.ID})
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+	enroll := enrollRequest{
+		Key:        base64.StdEncoding.EncodeToString(pubDER),
+		KeyType:    "secp256r1",
+		TunnelType: "masque",
+		Name:       o.DeviceName,
+	}
+	var enrolled accountData
+	if err := apiCall(ctx, client, http.MethodPatch, o.BaseURL+"/reg/"+acc.ID, acc.Token, enroll, &enrolled); err != nil {
+		return fmt.Errorf("enroll key: %w", err)
+	}
+	if len(enrolled.Config.Peers) == 0 {
+		return errors.New("enroll key: response without peers")
+	}
+	logutil.Info("masque key enrolled", map[string]string{"id": acc.ID})
+
+	privDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	peer := enrolled.Config.Peers[0]
+	license := enrolled.Account.License
+	if license == "" {
+		license = acc.Account.License
+	}
+	cfg := &usqueconfig.Config{
+		PrivateKey:     base64.StdEncoding.EncodeToString(privDER),
+		EndpointV4:     stripPort(peer.Endpoint.V4),
+		EndpointV6:     stripPort(peer.Endpoint.V6),
+		EndpointPubKey: peer.PublicKey,
+		License:        license,
+		ID:             acc.ID,
+		AccessToken:    acc.Token,
+		IPv4:           enrolled.Config.Interface.Addresses.V4,
+		IPv6:           enrolled.Config.Interface.Addresses.V6,
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("enrolled config is invalid: %w", err)
+	}
+	return cfg.Save(o.ConfigFile)
+}
+
+func apiCall(ctx context.Context, client *http.Client, method, url, token string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range apiHeaders {
+		req.Header.Set(k, v)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w: %v", ErrTimeout, err)
+		}
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s", ErrRateLimited, resp.Status)
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%w: server returned %s", ErrNetwork, resp.Status)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// stripPort turns "162.159.198.1:0" or "[2606:4700:103::1]:0" into the bare address.
+func stripPort(s string) string {
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		return h
+	}
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
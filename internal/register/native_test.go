@@ -0,0 +1,235 @@
+package register
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"masque-plus/internal/usqueconfig"
+)
+
+// fakeAPI mimics the registration API: POST /reg creates a device, PATCH
+// /reg/{id} enrolls its MASQUE key. fail answers the first requests with
+// the given statuses.
+type fakeAPI struct {
+	t      *testing.T
+	peerPK string
+
+	mu       sync.Mutex
+	fail     []int
+	calls    int
+	enrolled []byte // PKIX DER of the uploaded key
+}
+
+const (
+	fakeID    = "dev-123"
+	fakeToken = "tok-456"
+)
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(f.fail) > 0 {
+		code := f.fail[0]
+		f.fail = f.fail[1:]
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	if r.Header.Get("CF-Client-Version") == "" || r.Header.Get("User-Agent") == "" {
+		http.Error(w, "unknown client", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/reg":
+		var req regRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if key, err := base64.StdEncoding.DecodeString(req.Key); err != nil || len(key) != 32 {
+			f.t.Errorf("registration key is not a base64 X25519 key: %q", req.Key)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, req.Tos); err != nil {
+			f.t.Errorf("tos = %q: %v", req.Tos, err)
+		}
+		if req.InstallID == "" || !strings.HasPrefix(req.FcmToken, req.InstallID+":") {
+			f.t.Errorf("install_id %q / fcm_token %q", req.InstallID, req.FcmToken)
+		}
+		writeJSON(w, map[string]any{
+			"id":      fakeID,
+			"token":   fakeToken,
+			"account": map[string]any{"license": "lic-reg"},
+		})
+
+	case r.Method == http.MethodPatch && r.URL.Path == "/reg/"+fakeID:
+		if got := r.Header.Get("Authorization"); got != "Bearer "+fakeToken {
+			http.Error(w, "bad token "+got, http.StatusUnauthorized)
+			return
+		}
+		var req enrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.KeyType != "secp256r1" || req.TunnelType != "masque" {
+			f.t.Errorf("key_type %q, tunnel_type %q", req.KeyType, req.TunnelType)
+		}
+		der, err := base64.StdEncoding.DecodeString(req.Key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := x509.ParsePKIXPublicKey(der); err != nil {
+			f.t.Errorf("uploaded key is not PKIX: %v", err)
+		}
+		f.enrolled = der
+		writeJSON(w, map[string]any{
+			"id": fakeID,
+			"config": map[string]any{
+				"peers": []any{map[string]any{
+					"public_key": f.peerPK,
+					"endpoint":   map[string]any{"v4": "162.159.198.1:0", "v6": "[2606:4700:103::1]:0"},
+				}},
+				"interface": map[string]any{"addresses": map[string]any{"v4": "172.16.0.2", "v6": "2606:4700:110::2"}},
+			},
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newFakeAPI(t *testing.T, fail ...int) (*fakeAPI, *httptest.Server) {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &fakeAPI{
+		t:      t,
+		peerPK: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		fail:   fail,
+	}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func TestRunNative(t *testing.T) {
+	api, srv := newFakeAPI(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := RunNative(NativeOptions{BaseURL: srv.URL + "/", ConfigFile: path, AcceptTOS: true, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && st.Mode().Perm() != 0600 {
+		t.Errorf("config mode = %v, want 0600", st.Mode().Perm())
+	}
+	cfg, err := usqueconfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("written config is invalid: %v", err)
+	}
+	want := usqueconfig.Config{
+		EndpointV4:     "162.159.198.1",
+		EndpointV6:     "2606:4700:103::1",
+		EndpointPubKey: api.peerPK,
+		License:        "lic-reg", // the enroll response has none
+		ID:             fakeID,
+		AccessToken:    fakeToken,
+		IPv4:           "172.16.0.2",
+		IPv6:           "2606:4700:110::2",
+	}
+	got := *cfg
+	got.PrivateKey, got.Extra = "", nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %+v\nwant     %+v", got, want)
+	}
+
+	// the private key written must be the one whose public half was enrolled
+	der, err := base64.StdEncoding.DecodeString(cfg.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pub) != string(api.enrolled) {
+		t.Error("config private key does not match the enrolled public key")
+	}
+}
+
+func TestRunNativeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    []int
+		retries int
+		want    error // nil: success
+		calls   int
+	}{
+		{"retries a server error", []int{http.StatusBadGateway}, 1, nil, 3},
+		{"rate limited", []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, 1, ErrRateLimited, 2},
+		{"client error is final", []int{http.StatusForbidden}, 3, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, srv := newFakeAPI(t, tt.fail...)
+			path := filepath.Join(t.TempDir(), "config.json")
+			err := RunNative(NativeOptions{BaseURL: srv.URL, ConfigFile: path, AcceptTOS: true, Timeout: 5 * time.Second, Retries: tt.retries, Backoff: time.Millisecond})
+			switch {
+			case tt.want != nil:
+				if !errors.Is(err, tt.want) {
+					t.Errorf("err = %v, want %v", err, tt.want)
+				}
+			case tt.fail[0] == http.StatusForbidden:
+				if err == nil || Retryable(err) {
+					t.Errorf("err = %v, want a final error", err)
+				}
+			case err != nil:
+				t.Errorf("err = %v", err)
+			}
+			if api.calls != tt.calls {
+				t.Errorf("%d API calls, want %d", api.calls, tt.calls)
+			}
+			if _, statErr := os.Stat(path); (statErr == nil) != (err == nil) {
+				t.Errorf("config written = %v with err %v", statErr == nil, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package register
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"masque-plus/internal/logutil"
+)
+
+// Error classes returned (wrapped) by Run.
+var (
+	ErrTOSNotAccepted = errors.New("terms of service not accepted")
+	ErrRateLimited    = errors.New("rate limited by the registration API")
+	ErrNetwork        = errors.New("network failure during registration")
+	ErrTimeout        = errors.New("registration timed out")
+)
+
+// Options controls a usque registration.
+type Options struct {
+	UsquePath  string
+	ConfigFile string
+	DeviceName string
+
+	AcceptTOS bool          // answer the ToS prompt with "y" without asking
+	Timeout   time.Duration // per attempt
+	Retries   int           // extra attempts for retryable errors
+	Backoff   time.Duration // first retry delay, doubled each time
+}
+
+// Retryable reports whether another attempt may succeed.
+func Retryable(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrNetwork) || errors.Is(err, ErrTimeout)
+}
+
+// Run registers with usque, retrying rate-limit, network and timeout
+// failures with exponential backoff.
+func Run(o Options) error {
+	if o.DeviceName == "" {
+		o.DeviceName = "masque-plus"
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Minute
+	}
+	return retry(o.Retries, o.Backoff, func() error { return runOnce(o) })
+}
+
+// retry runs attempt until it succeeds, fails with a non-retryable error,
+// or retries are exhausted. The delay starts at backoff (default 2s),
+// doubles each time up to 30s, and gets up to 50% jitter.
+func retry(retries int, backoff time.Duration, attempt func() error) error {
+	if backoff <= 0 {
+		backoff = 2 * time.Second
+	}
+	delay := backoff
+	var err error
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+			logutil.Warn("registration failed; retrying", map[string]string{
+				"attempt": fmt.Sprintf("%d/%d", i+1, retries+1),
+				"wait":    wait.Round(time.Millisecond).String(),
+				"error":   err.Error(),
+			})
+			time.Sleep(wait)
+			if delay *= 2; delay > 30*time.Second {
+				delay = 30 * time.Second
+			}
+		}
+
+		err = attempt()
+		if err == nil || !Retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// prompt kinds
+const (
+	promptTOS       = "tos"
+	promptOverwrite = "overwrite"
+)
+
+type session struct {
+	o     Options
+	stdin io.WriteCloser
+
+	mu       sync.Mutex
+	answered map[string]bool
+	declined bool
+	lines    []string
+}
+
+func runOnce(o Options) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, o.UsquePath, "register", "-n", o.DeviceName, "--config", o.ConfigFile)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	s := &session{o: o, stdin: stdin, answered: map[string]bool{}}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); s.read(stdout) }()
+	go func() { defer wg.Done(); s.read(stderr) }()
+	wg.Wait()
+	_ = stdin.Close()
+	waitErr := cmd.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s", ErrTimeout, o.Timeout)
+	}
+	if s.declined {
+		return ErrTOSNotAccepted
+	}
+	if waitErr != nil {
+		return classify(waitErr, s.lines)
+	}
+	if _, err := os.Stat(o.ConfigFile); err != nil {
+		return fmt.Errorf("usque exited without writing %s: %w", o.ConfigFile, err)
+	}
+	return nil
+}
+
+// read consumes a child stream. Complete lines are logged; a trailing
+// partial line is checked for a prompt, since prompts don't end in '\n'.
+func (s *session) read(r io.Reader) {
+	buf := make([]byte, 4096)
+	var pending string
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			pending += string(buf[:n])
+			for {
+				i := strings.IndexByte(pending, '\n')
+				if i < 0 {
+					break
+				}
+				line := strings.TrimRight(pending[:i], "\r")
+				pending = pending[i+1:]
+				if !s.checkPrompt(line) {
+					s.logLine(line)
+				}
+			}
+			if s.checkPrompt(pending) {
+				pending = ""
+			}
+		}
+		if err != nil {
+			if strings.TrimSpace(pending) != "" {
+				s.logLine(pending)
+			}
+			return
+		}
+	}
+}
+
+func (s *session) logLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	s.mu.Lock()
+	s.lines = append(s.lines, line)
+	s.mu.Unlock()
+	logutil.Info("usque register", map[string]string{"output": line})
+}
+
+// checkPrompt answers a yes/no prompt once. It reports whether text was a prompt.
+func (s *session) checkPrompt(text string) bool {
+	lower := strings.ToLower(text)
+	if !strings.Contains(lower, "y/n") && !strings.HasSuffix(strings.TrimSpace(lower), "?") {
+		return false
+	}
+
+	kind := ""
+	switch {
+	case strings.Contains(lower, "terms of service") || strings.Contains(lower, "accept"):
+		kind = promptTOS
+	case strings.Contains(lower, "already have a config") || strings.Contains(lower, "overwrite"):
+		kind = promptOverwrite
+	default:
+		return false
+	}
+
+	s.mu.Lock()
+	if s.answered[kind] {
+		s.mu.Unlock()
+		return true
+	}
+	s.answered[kind] = true
+	s.mu.Unlock()
+
+	answer := "y"
+	if kind == promptTOS && !s.o.AcceptTOS {
+		answer = askUser(strings.TrimSpace(text))
+		if answer != "y" {
+			s.mu.Lock()
+			s.declined = true
+			s.mu.Unlock()
+		}
+	}
+	_, _ = io.WriteString(s.stdin, answer+"\n")
+	return true
+}
+
+// askUser forwards the ToS prompt to an interactive terminal. Without one
+// the terms are treated as declined.
+func askUser(prompt string) string {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		logutil.Warn("terms of service prompt needs an answer; rerun with --accept-tos", map[string]string{"prompt": prompt})
+		return "n"
+	}
+	fmt.Print(prompt + " ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	line = strings.ToLower(strings.TrimSpace(line))
+	if line == "y" || line == "yes" {
+		return "y"
+	}
+	return "n"
+}
+
+func classify(waitErr error, lines []string) error {
+	out := strings.ToLower(strings.Join(lines, "\n"))
+	switch {
+	case strings.Contains(out, "429") ||
+		strings.Contains(out, "too many requests") ||
+		strings.Contains(out, "rate limit"):
+		return fmt.Errorf("%w: %s", ErrRateLimited, lastLine(lines))
+	case strings.Contains(out, "dial tcp") ||
+		strings.Contains(out, "no such host") ||
+		strings.Contains(out, "i/o timeout") ||
+		strings.Contains(out, "connection refused") ||
+		strings.Contains(out, "connection reset") ||
+		strings.Contains(out, "network is unreachable") ||
+		strings.Contains(out, "tls handshake") ||
+		strings.Contains(out, "unexpected eof") ||
+		strings.Contains(out, ": eof"):
+		return fmt.Errorf("%w: %s", ErrNetwork, lastLine(lines))
+	case strings.Contains(out, "terms of service"):
+		return ErrTOSNotAccepted
+	}
+	if l := lastLine(lines); l != "" {
+		return fmt.Errorf("%v: %s", waitErr, l)
+	}
+	return waitErr
+}
+
+func lastLine(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,40 @@
+package register
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	exit := errors.New("exit status 1")
+	tests := []struct {
+		name string
+		line string
+		want error // nil: none of the error classes
+	}{
+		{"rate limited", "status code 429: Too Many Requests", ErrRateLimited},
+		{"dns", "dial tcp: lookup api.cloudflareclient.com: no such host", ErrNetwork},
+		{"reset", "read tcp 10.0.0.2:5555->1.1.1.1:443: connection reset by peer", ErrNetwork},
+		{"bare EOF", `Post "https://api.cloudflareclient.com/v0a4005/reg": EOF`, ErrNetwork},
+		{"unexpected EOF", "failed to read response: unexpected EOF", ErrNetwork},
+		{"eof inside a word", "invalid geofence setting", nil},
+		{"tos", "You must accept the Terms of Service", ErrTOSNotAccepted},
+		{"other", "invalid key format", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classify(exit, []string{"starting", tt.line})
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Errorf("classify(%q) = %v, want %v", tt.line, err, tt.want)
+				}
+				return
+			}
+			for _, class := range []error{ErrRateLimited, ErrNetwork, ErrTOSNotAccepted} {
+				if errors.Is(err, class) {
+					t.Errorf("classify(%q) = %v, want no class", tt.line, err)
+				}
+			}
+		})
+	}
+}
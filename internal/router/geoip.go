@@ -0,0 +1,108 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeoIP is an in-memory country database loaded from a CSV file.
+type GeoIP struct {
+	ranges []geoRange // sorted by start
+}
+
+type geoRange struct {
+	start, end net.IP // 16-byte form
+	country    string
+}
+
+// LoadGeoIP reads a CSV country database. Each line is either
+// "CIDR,CC" or "START_IP,END_IP,CC" (the db-ip/ip2location lite layout);
+// '#' lines are comments.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g := &GeoIP{}
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ",")
+		for i := range parts {
+			parts[i] = strings.Trim(strings.TrimSpace(parts[i]), `"`)
+		}
+
+		var rg geoRange
+		switch len(parts) {
+		case 2:
+			_, ipnet, err := net.ParseCIDR(parts[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+			}
+			rg.start, rg.end = cidrBounds(ipnet)
+			rg.country = strings.ToUpper(parts[1])
+		case 3:
+			s, e := net.ParseIP(parts[0]), net.ParseIP(parts[1])
+			if s == nil || e == nil {
+				return nil, fmt.Errorf("%s:%d: invalid IP range", path, lineNo)
+			}
+			rg.start, rg.end = s.To16(), e.To16()
+			rg.country = strings.ToUpper(parts[2])
+		default:
+			return nil, fmt.Errorf("%s:%d: expected CIDR,CC or START,END,CC", path, lineNo)
+		}
+		g.ranges = append(g.ranges, rg)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(g.ranges, func(i, j int) bool {
+		return bytes.Compare(g.ranges[i].start, g.ranges[j].start) < 0
+	})
+	return g, nil
+}
+
+// Lookup returns the country code for ip, or "" if unknown.
+func (g *GeoIP) Lookup(ip net.IP) string {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	// last range whose start <= ip
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].start, ip16) > 0
+	}) - 1
+	if i < 0 {
+		return ""
+	}
+	if bytes.Compare(ip16, g.ranges[i].end) <= 0 {
+		return g.ranges[i].country
+	}
+	return ""
+}
+
+func cidrBounds(n *net.IPNet) (net.IP, net.IP) {
+	start := n.IP.To16()
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+	}
+	end := make(net.IP, net.IPv6len)
+	for i := range end {
+		end[i] = start[i] | ^mask[i]
+	}
+	return start, end
+}
@@ -0,0 +1,314 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"masque-plus/internal/logutil"
+)
+
+// Action tells the front-end where to send a connection.
+type Action string
+
+const (
+	ActionDirect Action = "direct" // dial the destination directly
+	ActionProxy  Action = "proxy"  // dial through the usque SOCKS backend
+)
+
+// Rule kinds accepted in the rules file.
+const (
+	KindCIDR          = "cidr"
+	KindDomainSuffix  = "domain-suffix"
+	KindDomainKeyword = "domain-keyword"
+	KindGeoIP         = "geoip"
+	KindFinal         = "final"
+)
+
+// Rule is a single line of the rules file.
+type Rule struct {
+	Kind   string
+	Value  string
+	Action Action
+
+	ipnet *net.IPNet
+}
+
+// RuleSet is an ordered list of rules plus the fallback action.
+// The first matching rule wins.
+type RuleSet struct {
+	Rules []Rule
+	Final Action
+	GeoIP *GeoIP
+}
+
+// HasIPRules reports whether any rule needs the destination IP to match.
+func (rs *RuleSet) HasIPRules() bool {
+	for _, r := range rs.Rules {
+		if r.Kind == KindCIDR || r.Kind == KindGeoIP {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesDomain reports whether a domain rule matches host on its own.
+func (rs *RuleSet) MatchesDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range rs.Rules {
+		switch r.Kind {
+		case KindDomainSuffix:
+			if host == r.Value || strings.HasSuffix(host, "."+r.Value) {
+				return true
+			}
+		case KindDomainKeyword:
+			if strings.Contains(host, r.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Match evaluates the rules against a destination. host may be a domain or an
+// IP literal; ips are the resolved addresses (may be empty for domains).
+func (rs *RuleSet) Match(host string, ips []net.IP) Action {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append([]net.IP{ip}, ips...)
+		host = ""
+	}
+
+	for _, r := range rs.Rules {
+		switch r.Kind {
+		case KindDomainSuffix:
+			if host != "" && (host == r.Value || strings.HasSuffix(host, "."+r.Value)) {
+				return r.Action
+			}
+		case KindDomainKeyword:
+			if host != "" && strings.Contains(host, r.Value) {
+				return r.Action
+			}
+		case KindCIDR:
+			for _, ip := range ips {
+				if r.ipnet.Contains(ip) {
+					return r.Action
+				}
+			}
+		case KindGeoIP:
+			if rs.GeoIP == nil {
+				continue
+			}
+			for _, ip := range ips {
+				if rs.GeoIP.Lookup(ip) == r.Value {
+					return r.Action
+				}
+			}
+		}
+	}
+	return rs.Final
+}
+
+// ParseRules reads a rules file. Each non-empty line is "KIND,VALUE,ACTION"
+// (or "FINAL,ACTION"); lines starting with '#' are comments.
+//
+//	domain-suffix,example.ir,direct
+//	domain-keyword,google,proxy
+//	cidr,192.168.0.0/16,direct
+//	geoip,IR,direct
+//	final,proxy
+func ParseRules(path string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs := &RuleSet{Final: ActionProxy}
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		kind := strings.ToLower(parts[0])
+
+		if kind == KindFinal {
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%s:%d: final needs exactly one action", path, lineNo)
+			}
+			act, err := parseAction(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+			}
+			rs.Final = act
+			continue
+		}
+
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected KIND,VALUE,ACTION", path, lineNo)
+		}
+		act, err := parseAction(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		r, err := NewRule(kind, parts[1], act)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		rs.Rules = append(rs.Rules, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// NewRule builds a validated rule of the given kind.
+func NewRule(kind, value string, act Action) (Rule, error) {
+	r := Rule{Kind: strings.ToLower(kind), Value: strings.ToLower(strings.TrimSpace(value)), Action: act}
+
+	switch r.Kind {
+	case KindCIDR:
+		_, ipnet, err := net.ParseCIDR(r.Value)
+		if err != nil {
+			return Rule{}, err
+		}
+		r.ipnet = ipnet
+	case KindDomainSuffix:
+		r.Value = strings.TrimPrefix(strings.TrimSuffix(r.Value, "."), ".")
+	case KindDomainKeyword:
+	case KindGeoIP:
+		r.Value = strings.ToUpper(r.Value)
+	default:
+		return Rule{}, fmt.Errorf("unknown rule kind %q", kind)
+	}
+	return r, nil
+}
+
+// IPNet returns the parsed network of a cidr rule (nil for other kinds).
+func (r Rule) IPNet() *net.IPNet { return r.ipnet }
+
+func parseAction(s string) (Action, error) {
+	switch Action(strings.ToLower(s)) {
+	case ActionDirect:
+		return ActionDirect, nil
+	case ActionProxy:
+		return ActionProxy, nil
+	}
+	return "", fmt.Errorf("unknown action %q (want direct or proxy)", s)
+}
+
+// Router holds the active rule set and reloads it when the file changes.
+type Router struct {
+	rulesPath string
+	geoipPath string
+
+	mu      sync.RWMutex
+	rules   *RuleSet
+	modTime time.Time
+	geoMod  time.Time
+}
+
+// New loads the rules (and optional GeoIP database) and returns a Router.
+func New(rulesPath, geoipPath string) (*Router, error) {
+	r := &Router{rulesPath: rulesPath, geoipPath: geoipPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rules returns the currently active rule set.
+func (r *Router) Rules() *RuleSet {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rules
+}
+
+// Watch polls the rules and GeoIP files every interval and reloads them on
+// change. A broken file is logged and the previous rules stay active.
+func (r *Router) Watch(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				logutil.Warn("rules reload failed; keeping previous rules", map[string]string{
+					"file":  r.rulesPath,
+					"error": err.Error(),
+				})
+				continue
+			}
+			logutil.Info("rules reloaded", map[string]string{
+				"file":  r.rulesPath,
+				"rules": fmt.Sprint(len(r.Rules().Rules)),
+			})
+		}
+	}
+}
+
+func (r *Router) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if fi, err := os.Stat(r.rulesPath); err == nil && !fi.ModTime().Equal(r.modTime) {
+		return true
+	}
+	if r.geoipPath != "" {
+		if fi, err := os.Stat(r.geoipPath); err == nil && !fi.ModTime().Equal(r.geoMod) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) reload() error {
+	fi, err := os.Stat(r.rulesPath)
+	if err != nil {
+		return err
+	}
+	rs, err := ParseRules(r.rulesPath)
+	if err != nil {
+		return err
+	}
+
+	var geoMod time.Time
+	if r.geoipPath != "" {
+		gfi, err := os.Stat(r.geoipPath)
+		if err != nil {
+			return err
+		}
+		geo, err := LoadGeoIP(r.geoipPath)
+		if err != nil {
+			return err
+		}
+		rs.GeoIP = geo
+		geoMod = gfi.ModTime()
+	}
+
+	r.mu.Lock()
+	r.rules = rs
+	r.modTime = fi.ModTime()
+	r.geoMod = geoMod
+	r.mu.Unlock()
+	return nil
+}
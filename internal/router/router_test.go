@@ -0,0 +1,109 @@
+package router
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testRules(t *testing.T) *RuleSet {
+	t.Helper()
+	rs, err := ParseRules(writeFile(t, "rules.txt", `
+# comment
+domain-suffix,Example.IR.,direct
+domain-keyword,google,direct
+cidr,192.168.0.0/16,direct
+cidr,2001:db8::/32,direct
+geoip,ir,direct
+final,proxy
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.GeoIP, err = LoadGeoIP(writeFile(t, "geoip.csv", `
+5.0.0.0/16,IR
+"8.8.0.0","8.8.255.255","US"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestMatch(t *testing.T) {
+	rs := testRules(t)
+	tests := []struct {
+		name string
+		host string
+		ips  []string
+		want Action
+	}{
+		{"suffix exact", "example.ir", nil, ActionDirect},
+		{"suffix subdomain", "www.EXAMPLE.ir.", nil, ActionDirect},
+		{"suffix needs a dot boundary", "notexample.ir", nil, ActionProxy},
+		{"keyword", "mail.google.com", nil, ActionDirect},
+		{"cidr by resolved address", "printer.lan", []string{"192.168.1.10"}, ActionDirect},
+		{"cidr by IP literal", "192.168.7.7", nil, ActionDirect},
+		{"cidr IPv6 literal", "2001:db8::1", nil, ActionDirect},
+		{"geoip by IP literal", "5.0.9.9", nil, ActionDirect},
+		{"IP literal outside every rule", "5.1.2.3", nil, ActionProxy},
+		{"geoip", "site.example", []string{"5.0.3.4"}, ActionDirect},
+		{"geoip other country", "site.example", []string{"8.8.8.8"}, ActionProxy},
+		{"final", "example.com", nil, ActionProxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ips []net.IP
+			for _, s := range tt.ips {
+				ips = append(ips, net.ParseIP(s))
+			}
+			if got := rs.Match(tt.host, ips); got != tt.want {
+				t.Errorf("Match(%q, %v) = %s, want %s", tt.host, tt.ips, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesDomain(t *testing.T) {
+	rs := testRules(t)
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.ir", true},
+		{"a.b.example.ir.", true},
+		{"www.google.de", true},
+		{"example.com", false},
+		{"192.168.1.1", false},
+	}
+	for _, tt := range tests {
+		if got := rs.MatchesDomain(tt.host); got != tt.want {
+			t.Errorf("MatchesDomain(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []string{
+		"domain-suffix,example.ir",
+		"cidr,300.0.0.0/8,direct",
+		"domain-suffix,example.ir,block",
+		"asn,13335,direct",
+		"final,proxy,direct",
+	}
+	for _, line := range tests {
+		if _, err := ParseRules(writeFile(t, "rules.txt", line)); err == nil {
+			t.Errorf("ParseRules(%q) succeeded, want error", line)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package scanner
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"masque-plus/internal/rangeip"
+)
+
+// Subnet sizes the adaptive scanner learns about, and how much of that
+// history is kept: networks unseen for maxNetworkAge are forgotten, at most
+// maxNetworks networks are kept (most recently seen first) and each keeps
+// its maxSubnets most tried subnets.
+const (
+	subnetBits4 = 24
+	subnetBits6 = 64
+
+	maxNetworkAge = 90 * 24 * time.Hour
+	maxNetworks   = 32
+	maxSubnets    = 512
+)
+
+// subnetOf returns the /24 or /64 containing ep's address, or "" for
+// hostnames.
+func subnetOf(ep string) string {
+	host, _, err := net.SplitHostPort(ep)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(subnetBits4, 32)), Mask: net.CIDRMask(subnetBits4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(subnetBits6, 128)), Mask: net.CIDRMask(subnetBits6, 128)}).String()
+}
+
+// subnets returns the per-subnet stats of the current network, creating
+// them if needed. Callers hold s.mu.
+func (s *Stats) subnets() map[string]*PortStat {
+	m := s.Subnets[s.Network]
+	if m == nil {
+		m = map[string]*PortStat{}
+		s.Subnets[s.Network] = m
+	}
+	return m
+}
+
+// prune applies the history limits above. Callers hold s.mu.
+func (s *Stats) prune(now time.Time) {
+	for n := range s.Subnets {
+		if now.Sub(time.Unix(s.Seen[n], 0)) > maxNetworkAge {
+			delete(s.Subnets, n)
+		}
+	}
+	for n := range s.Seen {
+		if _, ok := s.Subnets[n]; !ok {
+			delete(s.Seen, n)
+		}
+	}
+	if len(s.Subnets) > maxNetworks {
+		nets := make([]string, 0, len(s.Subnets))
+		for n := range s.Subnets {
+			nets = append(nets, n)
+		}
+		sort.Slice(nets, func(i, j int) bool { return s.Seen[nets[i]] > s.Seen[nets[j]] })
+		for _, n := range nets[maxNetworks:] {
+			delete(s.Subnets, n)
+			delete(s.Seen, n)
+		}
+	}
+	for _, subs := range s.Subnets {
+		if len(subs) <= maxSubnets {
+			continue
+		}
+		keys := make([]string, 0, len(subs))
+		for sn := range subs {
+			keys = append(keys, sn)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := subs[keys[i]], subs[keys[j]]
+			if a.OK != b.OK {
+				return a.OK > b.OK
+			}
+			return a.OK+a.Fail > b.OK+b.Fail
+		})
+		for _, sn := range keys[maxSubnets:] {
+			delete(subs, sn)
+		}
+	}
+}
+
+// Adapt reorders candidates by Thompson sampling over their subnets'
+// success history on the current network: each subnet draws from
+// Beta(ok+1, fail+1), so productive subnets usually come first while
+// unexplored ones still get a chance. The port record breaks the tie
+// within a subnet.
+func (s *Stats) Adapt(candidates, ranges []string, rng *rand.Rand) {
+	if rng == nil {
+		rng = rand.New(rand.NewSource(rand.Int63()))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := s.subnets()
+	draw := map[string]float64{}
+	score := make(map[string]float64, len(candidates))
+	for _, ep := range candidates {
+		sn := subnetOf(ep)
+		d, ok := draw[sn]
+		if !ok {
+			ps := subs[sn]
+			if ps == nil {
+				ps = &PortStat{}
+			}
+			d = betaSample(rng, float64(ps.OK+1), float64(ps.Fail+1))
+			draw[sn] = d
+		}
+		cidr, port := locate(ep, ranges)
+		score[ep] = d * s.Ports[cidr][port].score()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return score[candidates[i]] > score[candidates[j]]
+	})
+}
+
+// Explore returns up to perSubnet fresh addresses from each of the top
+// subnets (within ranges) that produced working endpoints before, so a
+// random sample of a large range doesn't miss them. ver restricts the
+// family; ports are assigned as by BuildCandidates with PortRandom.
+func (s *Stats) Explore(ver int, ranges []string, top, perSubnet int, ports []string, rng *rand.Rand) []string {
+	if len(ports) == 0 {
+		ports = []string{"443"}
+	}
+	s.mu.Lock()
+	type entry struct {
+		cidr  string
+		score float64
+	}
+	var good []entry
+	for sn, ps := range s.subnets() {
+		if ps.OK == 0 {
+			continue
+		}
+		_, n, err := net.ParseCIDR(sn)
+		if err != nil || (ver == V4 && !isIPv4Net(n)) || (ver == V6 && isIPv4Net(n)) {
+			continue
+		}
+		if cidr, _ := locate(net.JoinHostPort(n.IP.String(), "0"), ranges); cidr == "" {
+			continue
+		}
+		good = append(good, entry{sn, ps.score()})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(good, func(i, j int) bool {
+		if good[i].score != good[j].score {
+			return good[i].score > good[j].score
+		}
+		return good[i].cidr < good[j].cidr
+	})
+	if len(good) > top {
+		good = good[:top]
+	}
+
+	var out []string
+	for _, g := range good {
+		ips, err := rangeip.SampleCIDR(g.cidr, perSubnet, 0, rng)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			out = append(out, net.JoinHostPort(ip.String(), pickPort(ports, rng)))
+		}
+	}
+	return out
+}
+
+// betaSample draws from Beta(a, b) via two gamma variates.
+func betaSample(rng *rand.Rand, a, b float64) float64 {
+	x := gammaSample(rng, a)
+	y := gammaSample(rng, b)
+	return x / (x + y)
+}
+
+// gammaSample draws from Gamma(k, 1) for k >= 1 (Marsaglia and Tsang).
+func gammaSample(rng *rand.Rand, k float64) float64 {
+	d := k - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
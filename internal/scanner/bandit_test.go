@@ -0,0 +1,124 @@
+package scanner
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRecordSubnetsOnlyWhenAdaptive(t *testing.T) {
+	for _, adaptive := range []bool{false, true} {
+		s := LoadStats("")
+		s.Network = "wifi"
+		s.Adaptive = adaptive
+		s.Record("162.159.192.5:443", nil, true)
+		if got := len(s.Subnets["wifi"]); got != map[bool]int{false: 0, true: 1}[adaptive] {
+			t.Errorf("adaptive=%v: %d subnets recorded", adaptive, got)
+		}
+	}
+}
+
+func TestAdapt(t *testing.T) {
+	ranges := []string{"162.159.0.0/16"}
+	s := LoadStats("")
+	s.Network = "wifi"
+	s.Adaptive = true
+	for i := 0; i < 20; i++ {
+		s.Record(fmt.Sprintf("162.159.1.%d:443", i+1), ranges, true)
+		s.Record(fmt.Sprintf("162.159.2.%d:443", i+1), ranges, false)
+	}
+
+	// The productive /24 should usually come first and the failing one
+	// last, while the unexplored /24 still leads now and then.
+	counts := map[string]int{}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		cands := []string{"162.159.2.200:443", "162.159.3.200:443", "162.159.1.200:443"}
+		s.Adapt(cands, ranges, rng)
+		counts[cands[0]]++
+		if cands[0] == "162.159.2.200:443" {
+			t.Fatalf("failing subnet ordered first: %v", cands)
+		}
+	}
+	if counts["162.159.1.200:443"] < 150 {
+		t.Errorf("productive subnet first %d/200 times", counts["162.159.1.200:443"])
+	}
+	if counts["162.159.3.200:443"] == 0 {
+		t.Error("unexplored subnet never tried first")
+	}
+}
+
+func TestAdaptPerNetwork(t *testing.T) {
+	s := LoadStats("")
+	s.Adaptive = true
+	s.Network = "home"
+	for i := 0; i < 20; i++ {
+		s.Record("162.159.1.1:443", nil, true)
+		s.Record("162.159.2.1:443", nil, false)
+	}
+	s.Network = "office"
+	for i := 0; i < 20; i++ {
+		s.Record("162.159.1.1:443", nil, false)
+		s.Record("162.159.2.1:443", nil, true)
+	}
+	rng := rand.New(rand.NewSource(2))
+	for _, tt := range []struct{ network, want string }{{"home", "162.159.1.9:443"}, {"office", "162.159.2.9:443"}} {
+		s.Network = tt.network
+		cands := []string{"162.159.1.9:443", "162.159.2.9:443"}
+		s.Adapt(cands, nil, rng)
+		if cands[0] != tt.want {
+			t.Errorf("%s: order %v, want %s first", tt.network, cands, tt.want)
+		}
+	}
+}
+
+func TestExplore(t *testing.T) {
+	s := LoadStats("")
+	s.Network = "wifi"
+	s.Adaptive = true
+	s.Record("162.159.1.1:443", nil, true)
+	s.Record("162.159.2.1:443", nil, false)
+	s.Record("10.0.0.1:443", nil, true) // outside the ranges
+	out := s.Explore(V4, []string{"162.159.0.0/16"}, 8, 4, []string{"8443"}, rand.New(rand.NewSource(3)))
+	if len(out) != 4 {
+		t.Fatalf("Explore = %v, want 4 addresses from 162.159.1.0/24", out)
+	}
+	for _, ep := range out {
+		if subnetOf(ep) != "162.159.1.0/24" {
+			t.Errorf("%s not in the productive subnet", ep)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	s := LoadStats("")
+	s.Subnets["stale"] = map[string]*PortStat{"1.0.0.0/24": {OK: 1}}
+	s.Seen["stale"] = now.Add(-maxNetworkAge - time.Hour).Unix()
+	for i := 0; i < maxNetworks+3; i++ {
+		n := fmt.Sprintf("net%d", i)
+		s.Subnets[n] = map[string]*PortStat{"1.0.0.0/24": {OK: 1}}
+		s.Seen[n] = now.Add(-time.Duration(i) * time.Minute).Unix()
+	}
+	big := map[string]*PortStat{}
+	for i := 0; i < maxSubnets+10; i++ {
+		big[fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)] = &PortStat{Fail: 1}
+	}
+	big["162.159.1.0/24"] = &PortStat{OK: 5}
+	s.Subnets["net0"] = big
+
+	s.prune(now)
+	if _, ok := s.Subnets["stale"]; ok {
+		t.Error("stale network kept")
+	}
+	if len(s.Subnets) != maxNetworks || len(s.Seen) != maxNetworks {
+		t.Errorf("%d networks (%d seen), want %d", len(s.Subnets), len(s.Seen), maxNetworks)
+	}
+	if _, ok := s.Subnets[fmt.Sprintf("net%d", maxNetworks)]; ok {
+		t.Error("least recently seen network kept")
+	}
+	if len(s.Subnets["net0"]) != maxSubnets || s.Subnets["net0"]["162.159.1.0/24"] == nil {
+		t.Errorf("net0 has %d subnets; productive subnet kept: %v", len(s.Subnets["net0"]), s.Subnets["net0"]["162.159.1.0/24"] != nil)
+	}
+}
@@ -0,0 +1,228 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Probe failure kinds. A probe that fails any other way (e.g. a TLS
+// alert) still got an answer, so the path is not blocked.
+const (
+	failTimeout     = "timed out"
+	failUnreachable = "unreachable"
+)
+
+// DefaultFallbackPorts are the other UDP ports Cloudflare's WARP edge
+// answers on, tried when 443 looks blocked.
+var DefaultFallbackPorts = []string{"500", "1701", "4500", "4443", "8443", "8095"}
+
+// probeFailure classifies a QUIC dial error as a timeout, an ICMP
+// unreachable, or "" for anything that proves the path passes packets.
+func probeFailure(err error) string {
+	var idle *quic.IdleTimeoutError
+	var hs *quic.HandshakeTimeoutError
+	var ne net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return failUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &idle), errors.As(err, &hs),
+		errors.As(err, &ne) && ne.Timeout():
+		return failTimeout
+	}
+	return ""
+}
+
+// pathClass groups endpoints that usually share a middlebox verdict:
+// address family plus UDP port, e.g. "v4/443".
+func pathClass(ep string) string {
+	host, port, err := net.SplitHostPort(ep)
+	if err != nil {
+		return ep
+	}
+	fam := "v4"
+	if ip := net.ParseIP(trimBrackets(host)); ip != nil && ip.To4() == nil {
+		fam = "v6"
+	}
+	return fam + "/" + port
+}
+
+// BlockDetector watches QUIC precheck results for systematic blocking.
+// Once Threshold probes in a row on one family/port time out (or are
+// refused by ICMP) without a single answer, that path counts as blocked:
+// the remaining candidates on it are skipped, and if FallbackPorts are
+// set their addresses are retried on the next port that isn't blocked.
+type BlockDetector struct {
+	Threshold     int      // consecutive failures before a path counts as blocked (default 5)
+	FallbackPorts []string // ports to move blocked candidates to
+
+	mu      sync.Mutex
+	streak  map[string]int
+	kind    map[string]string
+	seen    map[string]bool // at least one probe got an answer
+	blocked map[string]string
+	icmp    map[string]string
+}
+
+func (d *BlockDetector) init() {
+	if d.streak == nil {
+		d.streak = map[string]int{}
+		d.kind = map[string]string{}
+		d.seen = map[string]bool{}
+		d.blocked = map[string]string{}
+		d.icmp = map[string]string{}
+	}
+	if d.Threshold <= 0 {
+		d.Threshold = 5
+	}
+}
+
+// Observe records a probe result for ep and reports whether it made the
+// path of ep count as blocked.
+func (d *BlockDetector) Observe(ep string, err error) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	c := pathClass(ep)
+	kind := probeFailure(err)
+	if kind == "" {
+		d.seen[c] = true
+		d.streak[c] = 0
+		return false
+	}
+	if d.seen[c] || d.blocked[c] != "" {
+		return false
+	}
+	d.streak[c]++
+	if kind == failUnreachable {
+		d.kind[c] = kind
+	} else if d.kind[c] == "" {
+		d.kind[c] = kind
+	}
+	if d.streak[c] < d.Threshold {
+		return false
+	}
+	d.blocked[c] = d.kind[c]
+	if d.kind[c] == failTimeout {
+		d.icmp[c] = udpVerdict(ep, 500*time.Millisecond)
+	}
+	return true
+}
+
+// Blocked reports whether ep's path counts as blocked.
+func (d *BlockDetector) Blocked(ep string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	return d.blocked[pathClass(ep)] != ""
+}
+
+// Reroute drops the blocked candidates from rest and appends each of
+// their addresses once more on the first fallback port whose path isn't
+// blocked (and that isn't queued already).
+func (d *BlockDetector) Reroute(rest []string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	queued := map[string]bool{}
+	for _, ep := range rest {
+		queued[ep] = true
+	}
+	var keep, moved []string
+	for _, ep := range rest {
+		if d.blocked[pathClass(ep)] == "" {
+			keep = append(keep, ep)
+			continue
+		}
+		host, _, err := net.SplitHostPort(ep)
+		if err != nil {
+			continue
+		}
+		for _, p := range d.FallbackPorts {
+			alt := net.JoinHostPort(trimBrackets(host), p)
+			if queued[alt] || d.blocked[pathClass(alt)] != "" {
+				continue
+			}
+			queued[alt] = true
+			moved = append(moved, alt)
+			break
+		}
+	}
+	return append(keep, moved...)
+}
+
+// Diagnose describes the blocked paths, or returns "" if none are.
+func (d *BlockDetector) Diagnose() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	if len(d.blocked) == 0 {
+		return ""
+	}
+	classes := make([]string, 0, len(d.blocked))
+	for c := range d.blocked {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	parts := make([]string, 0, len(classes))
+	for _, c := range classes {
+		s := fmt.Sprintf("UDP %s: %d probes %s", c, d.streak[c], d.blocked[c])
+		if v := d.icmp[c]; v != "" {
+			s += " (" + v + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// udpVerdict sends one datagram on a connected socket so an ICMP error,
+// which an unconnected QUIC socket never surfaces, can be told apart from
+// packets being silently dropped.
+func udpVerdict(ep string, wait time.Duration) string {
+	c, err := net.Dial("udp", ep)
+	if err != nil {
+		return err.Error()
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(wait))
+	// A long-header packet with an unsupported version; a QUIC server
+	// answers with Version Negotiation, a closed port with ICMP.
+	pkt := make([]byte, 1200)
+	pkt[0] = 0xc0
+	copy(pkt[1:5], []byte{0x1a, 0x2a, 0x3a, 0x4a})
+	pkt[5], pkt[14] = 8, 8
+	if _, err := c.Write(pkt); err != nil {
+		return describeUnreachable(err)
+	}
+	buf := make([]byte, 1500)
+	if _, err := c.Read(buf); err != nil {
+		return describeUnreachable(err)
+	}
+	return "answers plain UDP, QUIC handshakes filtered"
+}
+
+func describeUnreachable(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "ICMP port unreachable"
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return "ICMP host unreachable or administratively prohibited"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "no route to network"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "silently dropped"
+	}
+	return err.Error()
+}
@@ -0,0 +1,172 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var (
+	errTimeout     = &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+	errUnreachable = &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendmsg", syscall.ECONNREFUSED)}
+	errAnswered    = errors.New("CRYPTO_ERROR 0x12a: tls: handshake failure")
+)
+
+func TestProbeFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"ok", nil, ""},
+		{"deadline", context.DeadlineExceeded, failTimeout},
+		{"net timeout", errTimeout, failTimeout},
+		{"refused", errUnreachable, failUnreachable},
+		{"host unreachable", &net.OpError{Op: "write", Err: syscall.EHOSTUNREACH}, failUnreachable},
+		{"tls alert", errAnswered, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := probeFailure(tt.err); got != tt.want {
+				t.Errorf("probeFailure(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathClass(t *testing.T) {
+	tests := map[string]string{
+		"162.159.198.1:443":      "v4/443",
+		"162.159.198.1:4500":     "v4/4500",
+		"[2606:4700:103::1]:443": "v6/443",
+		"engage.example:443":     "v4/443",
+		"no-port":                "no-port",
+	}
+	for ep, want := range tests {
+		if got := pathClass(ep); got != want {
+			t.Errorf("pathClass(%q) = %q, want %q", ep, got, want)
+		}
+	}
+}
+
+func TestBlockDetectorObserve(t *testing.T) {
+	type probe struct {
+		ep  string
+		err error
+	}
+	tests := []struct {
+		name    string
+		probes  []probe
+		blocks  int // index of the probe that should report blocked, -1 for none
+		blocked []string
+		clear   []string
+	}{
+		{
+			name:    "unreachable streak",
+			probes:  []probe{{"10.0.0.1:443", errUnreachable}, {"10.0.0.2:443", errUnreachable}, {"10.0.0.3:443", errUnreachable}},
+			blocks:  2,
+			blocked: []string{"10.0.0.9:443"},
+			clear:   []string{"10.0.0.1:4500", "[2606:4700::1]:443"},
+		},
+		{
+			name:   "answer resets the streak",
+			probes: []probe{{"10.0.0.1:443", errUnreachable}, {"10.0.0.2:443", errUnreachable}, {"10.0.0.3:443", nil}, {"10.0.0.4:443", errUnreachable}},
+			blocks: -1,
+			clear:  []string{"10.0.0.1:443"},
+		},
+		{
+			name:   "a path that answered once is never blocked",
+			probes: []probe{{"10.0.0.1:443", errAnswered}, {"10.0.0.2:443", errUnreachable}, {"10.0.0.3:443", errUnreachable}, {"10.0.0.4:443", errUnreachable}},
+			blocks: -1,
+			clear:  []string{"10.0.0.1:443"},
+		},
+		{
+			name:    "families counted apart",
+			probes:  []probe{{"10.0.0.1:443", errUnreachable}, {"[2606:4700::1]:443", errUnreachable}, {"10.0.0.2:443", errUnreachable}, {"[2606:4700::2]:443", errUnreachable}, {"[2606:4700::3]:443", errUnreachable}},
+			blocks:  4,
+			blocked: []string{"[2606:4700::9]:443"},
+			clear:   []string{"10.0.0.9:443"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &BlockDetector{Threshold: 3}
+			for i, p := range tt.probes {
+				if got := d.Observe(p.ep, p.err); got != (i == tt.blocks) {
+					t.Errorf("Observe #%d (%s) = %v", i, p.ep, got)
+				}
+			}
+			for _, ep := range tt.blocked {
+				if !d.Blocked(ep) {
+					t.Errorf("%s not blocked", ep)
+				}
+			}
+			for _, ep := range tt.clear {
+				if d.Blocked(ep) {
+					t.Errorf("%s blocked", ep)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockDetectorReroute(t *testing.T) {
+	d := &BlockDetector{Threshold: 1, FallbackPorts: []string{"500", "4500"}}
+	d.Observe("10.0.0.1:443", errUnreachable)
+	d.Observe("10.0.0.1:500", errUnreachable)
+
+	tests := []struct {
+		name string
+		rest []string
+		want []string
+	}{
+		{"open path kept", []string{"[2606:4700::1]:443"}, []string{"[2606:4700::1]:443"}},
+		{"skips blocked fallback", []string{"10.0.0.2:443"}, []string{"10.0.0.2:4500"}},
+		{"moved after kept", []string{"10.0.0.2:443", "10.0.0.3:8443"}, []string{"10.0.0.3:8443", "10.0.0.2:4500"}},
+		{"no duplicates", []string{"10.0.0.2:443", "10.0.0.2:4500"}, []string{"10.0.0.2:4500"}},
+		{"unblocked port kept", []string{"[2606:4700::1]:500"}, []string{"[2606:4700::1]:500"}},
+		{"blocked on every port", []string{"10.0.0.2:500"}, []string{"10.0.0.2:4500"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Reroute(tt.rest); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Reroute(%v) = %v, want %v", tt.rest, got, tt.want)
+			}
+		})
+	}
+
+	d.Observe("10.0.0.1:4500", errUnreachable)
+	if got := d.Reroute([]string{"10.0.0.2:443"}); len(got) != 0 {
+		t.Errorf("Reroute with every port blocked = %v, want none", got)
+	}
+}
+
+func TestBlockDetectorDiagnose(t *testing.T) {
+	d := &BlockDetector{Threshold: 2}
+	if got := d.Diagnose(); got != "" {
+		t.Errorf("Diagnose() = %q before any probe", got)
+	}
+	d.Observe("[2606:4700::1]:443", errUnreachable)
+	d.Observe("[2606:4700::2]:443", errTimeout) // an ICMP error wins over timeouts
+	// timed-out paths are checked with a plain UDP datagram; nothing
+	// listens on the discard port locally, so this returns quickly
+	d.Observe("127.0.0.1:9", errTimeout)
+	d.Observe("127.0.0.2:9", errTimeout)
+
+	got := d.Diagnose()
+	parts := strings.Split(got, "; ")
+	if len(parts) != 2 {
+		t.Fatalf("Diagnose() = %q, want two paths", got)
+	}
+	if !strings.HasPrefix(parts[0], "UDP v4/9: 2 probes timed out (") {
+		t.Errorf("v4 part = %q", parts[0])
+	}
+	if parts[1] != "UDP v6/443: 2 probes unreachable" {
+		t.Errorf("v6 part = %q", parts[1])
+	}
+}
@@ -2,7 +2,10 @@ package scanner
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
@@ -12,6 +15,7 @@ import (
 	"time"
 
 	"masque-plus/internal/logutil"
+	"masque-plus/internal/rangeip"
 
 	"github.com/quic-go/quic-go"
 )
@@ -23,35 +27,134 @@ const (
 	V6
 )
 
+// Port strategies for BuildCandidates.
+const (
+	PortRandom = "random" // one randomly chosen port per IP
+	PortCross  = "cross"  // every IP with every port
+)
+
+// Reasons recorded for each attempted candidate.
+const (
+	ReasonOK        = "ok"
+	ReasonPrecheck  = "precheck"  // the precheck probe (QUIC or TLS) failed
+	ReasonStart     = "start"     // usque could not be started
+	ReasonHandshake = "handshake" // usque reported a handshake failure
+	ReasonTunnel    = "tunnel"    // usque kept failing to connect the tunnel
+	ReasonTimeout   = "timeout"   // not connected within the per-endpoint timeout
+	ReasonIdentity  = "identity"  // usque rejected the account itself
+)
+
+// Rejection is returned by a startFn to reject a candidate for a specific
+// reason (e.g. a failed connectivity check) instead of ReasonStart. A Fatal
+// rejection stops the scan: no other candidate could succeed either.
+type Rejection struct {
+	Reason string
+	Err    error
+	Fatal  bool
+}
+
+func (r *Rejection) Error() string {
+	if r.Err == nil {
+		return r.Reason
+	}
+	return r.Reason + ": " + r.Err.Error()
+}
+
+func (r *Rejection) Unwrap() error { return r.Err }
+
+// Attempt is the outcome of one tried candidate.
+type Attempt struct {
+	Endpoint string
+	OK       bool
+	Reason   string
+	Detail   string
+	Elapsed  time.Duration
+}
+
 // TryCandidates iterates endpoints and returns the first that succeeds.
 // maxToTry limits how many endpoints will be attempted (cap).
 func TryCandidates(
 	candidates []string,
 	maxToTry int,
-	ping bool,
-	pingTimeout time.Duration,       // used by QUIC precheck
+	probe func(ep string) error,      // optional precheck, e.g. Prober(o)
+	probeName string,                 // what probe checks, for logs, e.g. "quic"
 	perEndpointTimeout time.Duration, // informational; enforced by startFn
 	startFn func(ep string) (stop func(), ok bool, err error),
+	onResult func(Attempt), // optional; called once per attempted endpoint
 ) (string, error) {
+	found, err := TryCandidatesN(candidates, 1, maxToTry, probe, probeName, perEndpointTimeout, startFn, onResult, nil)
+	if err != nil {
+		return "", err
+	}
+	return found[0], nil
+}
 
-	if maxToTry <= 0 || maxToTry > len(candidates) {
-		maxToTry = len(candidates)
+// TryCandidatesN is like TryCandidates but keeps going until want endpoints
+// succeeded (or maxToTry were attempted). It fails if none succeeded, or
+// as soon as startFn returns a Fatal Rejection.
+// A non-nil det watches the prechecks: candidates on paths it finds
+// blocked are skipped without counting against maxToTry, and the scan
+// stops early with its diagnosis once nothing unblocked is left.
+func TryCandidatesN(
+	candidates []string,
+	want int,
+	maxToTry int,
+	probe func(ep string) error,
+	probeName string,
+	perEndpointTimeout time.Duration,
+	startFn func(ep string) (stop func(), ok bool, err error),
+	onResult func(Attempt),
+	det *BlockDetector,
+) ([]string, error) {
+	if want <= 0 {
+		want = 1
 	}
+	var found []string
 
-	for i := 0; i < maxToTry; i++ {
-		
-		if i < maxToTry-1 {
-			time.Sleep(1 * time.Second)
+	var began time.Time
+	report := func(ep, reason string, err error) {
+		if onResult == nil {
+			return
+		}
+		r := Attempt{Endpoint: ep, OK: reason == ReasonOK, Reason: reason, Elapsed: time.Since(began)}
+		if err != nil {
+			r.Detail = err.Error()
 		}
-		
-		ep := candidates[i]
-		logutil.Info("candidate", map[string]string{"endpoint": ep, "idx": fmt.Sprint(i + 1), "of": fmt.Sprint(maxToTry)})
+		onResult(r)
+	}
 
-		if ping {
-			if !quicProbe(ep, pingTimeout) {
-				logutil.Info("precheck failed (quic probe)", map[string]string{"endpoint": ep, "timeout": pingTimeout.String()})
+	queue := append([]string(nil), candidates...)
+	if maxToTry <= 0 || maxToTry > len(queue) {
+		maxToTry = len(queue)
+	}
+
+	tried := 0
+	for i := 0; i < len(queue) && tried < maxToTry; i++ {
+		ep := queue[i]
+		if det != nil && det.Blocked(ep) {
+			continue
+		}
+		if tried > 0 {
+			time.Sleep(1 * time.Second)
+		}
+		tried++
+
+		began = time.Now()
+		logutil.Info("candidate", map[string]string{"endpoint": ep, "idx": fmt.Sprint(tried), "of": fmt.Sprint(maxToTry)})
+
+		if probe != nil {
+			if err := probe(ep); err != nil {
+				logutil.Info("precheck failed ("+probeName+" probe)", map[string]string{"endpoint": ep, "err": err.Error()})
+				report(ep, ReasonPrecheck, err)
+				if det != nil && det.Observe(ep, err) {
+					logutil.Warn("path looks blocked, switching", map[string]string{"path": pathClass(ep), "diagnosis": det.Diagnose()})
+					queue = append(queue[:i+1], det.Reroute(queue[i+1:])...)
+				}
 				continue
 			}
+			if det != nil {
+				det.Observe(ep, nil)
+			}
 		}
 
 		stop, ok, err := startFn(ep)
@@ -61,7 +164,16 @@ func TryCandidates(
 			if stop != nil {
 				stop()
 			}
-			logutil.Info("start failed", map[string]string{"endpoint": ep, "err": err.Error()})
+			reason := ReasonStart
+			var rej *Rejection
+			if errors.As(err, &rej) {
+				reason = rej.Reason
+			}
+			logutil.Info("candidate rejected", map[string]string{"endpoint": ep, "reason": reason, "err": err.Error()})
+			report(ep, reason, err)
+			if rej != nil && rej.Fatal {
+				return nil, fmt.Errorf("scan stopped at %s: %w", ep, err)
+			}
 			continue
 		}
 		if ok {
@@ -69,7 +181,11 @@ func TryCandidates(
 			if stop != nil {
 				stop()
 			}
-			return ep, nil
+			report(ep, ReasonOK, nil)
+			if found = append(found, ep); len(found) >= want {
+				return found, nil
+			}
+			continue
 		}
 
 		logutil.Info("not ready within per-endpoint timeout", map[string]string{
@@ -79,16 +195,46 @@ func TryCandidates(
 		if stop != nil {
 			stop()
 		}
+		report(ep, ReasonTimeout, nil)
+	}
+
+	if len(found) > 0 {
+		return found, nil
+	}
+	if det != nil {
+		if diag := det.Diagnose(); diag != "" {
+			return nil, fmt.Errorf("no viable endpoint found (tried %d); QUIC looks blocked on this network: %s", tried, diag)
+		}
 	}
+	return nil, fmt.Errorf("no viable endpoint found (tried %d)", tried)
+}
 
-	return "", fmt.Errorf("no viable endpoint found (tried %d)", maxToTry)
+// Sampling controls how CIDR ranges are turned into host addresses.
+type Sampling struct {
+	PerCIDR   int        // random IPs per CIDR; 0 enumerates IPv4 and samples v6Cap per IPv6 range
+	Stratify4 int        // IPv4 sub-prefix length to spread samples over (0 = off)
+	Stratify6 int        // IPv6 sub-prefix length, e.g. 64 for one sample per /64
+	Rand      *rand.Rand // seeded source for reproducible scans; nil = random
 }
 
+// v6Cap bounds IPv6 sampling when no explicit per-CIDR count is given.
+const v6Cap = 1024
+
 // BuildCandidates expands IPv4/IPv6 CIDR ranges into a list of endpoints "host:port" (IPv6 as "[host]:port").
-// BuildCandidates expands IPv4/IPv6 CIDR ranges into a list of endpoints "host:port" (IPv6 as "[host]:port").
-// For each host, a port is chosen randomly from 'ports' if len(ports) > 1; otherwise the single port is used.
-func BuildCandidates(ver int, v4CIDRs, v6CIDRs []string, ports []string) ([]string, error) {
+// With PortRandom, a port is chosen randomly from 'ports' for each host; with PortCross every host is
+// paired with every port. Duplicate endpoints (e.g. from overlapping ranges) are dropped.
+func BuildCandidates(ver int, v4CIDRs, v6CIDRs []string, ports []string, strategy string, smp Sampling) ([]string, error) {
 	var out []string
+	seen := map[string]bool{}
+	add := func(ip net.IP) {
+		for _, p := range portsFor(ports, strategy, smp.Rand) {
+			ep := net.JoinHostPort(ip.String(), p)
+			if !seen[ep] {
+				seen[ep] = true
+				out = append(out, ep)
+			}
+		}
+	}
 
 	if len(ports) == 0 {
 		ports = []string{"443"} // hard default
@@ -102,32 +248,51 @@ func BuildCandidates(ver int, v4CIDRs, v6CIDRs []string, ports []string) ([]stri
 				logutil.Info("bad cidr", map[string]string{"cidr": c, "err": err.Error()})
 				continue
 			}
-			if isIPv4Net(ipnet) {
-				for ip := firstHost(ipnet); ip != nil && ipnet.Contains(ip); ip = nextIP(ip) {
-					if isNetworkOrBroadcast(ip, ipnet) {
-						continue
-					}
-					out = append(out, net.JoinHostPort(ip.String(), pickPort(ports)))
+			if !isIPv4Net(ipnet) {
+				continue
+			}
+			if smp.PerCIDR > 0 {
+				ips, err := rangeip.SampleCIDR(ipnet.String(), smp.PerCIDR, smp.Stratify4, smp.Rand)
+				if err != nil {
+					logutil.Info("bad cidr", map[string]string{"cidr": c, "err": err.Error()})
+					continue
+				}
+				for _, ip := range ips {
+					add(ip)
 				}
+				continue
+			}
+			for ip := firstHost(ipnet); ip != nil && ipnet.Contains(ip); ip = nextIP(ip) {
+				if isNetworkOrBroadcast(ip, ipnet) {
+					continue
+				}
+				add(ip)
 			}
 		}
 	}
 
-	// IPv6 (sample cap to avoid explosion)
+	// IPv6 is always sampled; enumerating from the start of a /48 only covers one tiny corner.
 	if ver == Any || ver == V6 {
-		const v6Cap = 1024
+		n := smp.PerCIDR
+		if n <= 0 {
+			n = v6Cap
+		}
 		for _, c := range v6CIDRs {
 			ipnet, err := parseCIDR(c)
 			if err != nil {
 				logutil.Info("bad cidr", map[string]string{"cidr": c, "err": err.Error()})
 				continue
 			}
-			if !isIPv4Net(ipnet) {
-				count := 0
-				for ip := firstHost(ipnet); ip != nil && ipnet.Contains(ip) && count < v6Cap; ip = nextIP(ip) {
-					out = append(out, fmt.Sprintf("[%s]:%s", ip.String(), pickPort(ports)))
-					count++
-				}
+			if isIPv4Net(ipnet) {
+				continue
+			}
+			ips, err := rangeip.SampleCIDR(ipnet.String(), n, smp.Stratify6, smp.Rand)
+			if err != nil {
+				logutil.Info("bad cidr", map[string]string{"cidr": c, "err": err.Error()})
+				continue
+			}
+			for _, ip := range ips {
+				add(ip)
 			}
 		}
 	}
@@ -135,49 +300,162 @@ func BuildCandidates(ver int, v4CIDRs, v6CIDRs []string, ports []string) ([]stri
 	return out, nil
 }
 
-func pickPort(ports []string) string {
+func portsFor(ports []string, strategy string, rng *rand.Rand) []string {
+	if strategy == PortCross {
+		return ports
+	}
+	return []string{pickPort(ports, rng)}
+}
+
+func pickPort(ports []string, rng *rand.Rand) string {
 	if len(ports) == 1 {
 		return ports[0]
 	}
+	if rng != nil {
+		return ports[rng.Intn(len(ports))]
+	}
 	return ports[rand.Intn(len(ports))]
 }
 
 
 // ---- QUIC precheck ----
 
-// quicProbe does a quick QUIC (HTTP/3) handshake attempt against ep ("host:port" or "[v6]:port").
-// Returns true if the handshake succeeds within timeout.
-func quicProbe(ep string, timeout time.Duration) bool {
-	if timeout <= 0 {
-		timeout = 1 * time.Second
+// TunnelALPN is the ALPN the MASQUE tunnel negotiates.
+const TunnelALPN = "h3"
+
+// ProbeOptions tunes a QUIC precheck. The zero value probes with generic
+// HTTP/3 settings; TunnelProbe matches what usque sends.
+type ProbeOptions struct {
+	SNI               string // empty: the endpoint's host if it is a hostname, else none
+	Timeout           time.Duration
+	ALPN              []string       // default: common h3 ALPNs
+	Versions          []quic.Version // default: quic-go's
+	InitialPacketSize uint16         // 0: quic-go's default
+	KeepAlive         time.Duration
+	Datagrams         bool
+	TCP               bool // TLS over TCP (the HTTP/2 transport) instead of QUIC
+	NoPMTUD           bool // keep packets at InitialPacketSize after the handshake
+	// PeerKey, when set, must be the public key of the server certificate
+	// (the config's endpoint_pub_key), as usque checks it.
+	PeerKey crypto.PublicKey
+}
+
+// ErrPeerKeyMismatch is returned by a probe whose server certificate does
+// not carry ProbeOptions.PeerKey.
+var ErrPeerKeyMismatch = errors.New("server certificate does not match endpoint_pub_key")
+
+// TunnelProbe returns probe options mirroring the tunnel's handshake: its
+// SNI, initial packet size and keepalive, ALPN h3 over QUIC v1, and
+// datagram support, so that what passes the probe passes for usque too.
+func TunnelProbe(sni string, initialPacketSize int, keepalive, timeout time.Duration) ProbeOptions {
+	return ProbeOptions{
+		SNI:               sni,
+		Timeout:           timeout,
+		ALPN:              []string{TunnelALPN},
+		Versions:          []quic.Version{quic.Version1},
+		InitialPacketSize: uint16(initialPacketSize),
+		KeepAlive:         keepalive,
+		Datagrams:         true,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+}
 
+// tlsConfig is the TLS side of a probe to ep.
+func (o ProbeOptions) tlsConfig(ep string) *tls.Config {
 	tconf := &tls.Config{
-		InsecureSkipVerify: true,                                // probe only
+		InsecureSkipVerify: true,                                // no CA chain; PeerKey pins the key instead
 		NextProtos:         []string{"h3", "h3-29", "h3-32"},    // common ALPNs
+		ServerName:         o.SNI,
+	}
+	if len(o.ALPN) > 0 {
+		tconf.NextProtos = o.ALPN
 	}
-	// set SNI only if host is a hostname (not an IP)
-	if host, _, err := net.SplitHostPort(ep); err == nil {
+	if o.PeerKey != nil {
+		tconf.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return ErrPeerKeyMismatch
+			}
+			cert, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			if k, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(o.PeerKey) {
+				return ErrPeerKeyMismatch
+			}
+			return nil
+		}
+	}
+	// default SNI only if host is a hostname (not an IP)
+	if host, _, err := net.SplitHostPort(ep); err == nil && o.SNI == "" {
 		if net.ParseIP(trimBrackets(host)) == nil {
 			tconf.ServerName = host
 		}
 	}
+	return tconf
+}
+
+// quicConfig is the QUIC side of a probe; idle timeouts follow o.Timeout.
+func (o ProbeOptions) quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:    o.timeout(),
+		MaxIdleTimeout:          o.timeout(),
+		KeepAlivePeriod:         o.KeepAlive,
+		Versions:                o.Versions,
+		InitialPacketSize:       o.InitialPacketSize,
+		EnableDatagrams:         o.Datagrams,
+		DisablePathMTUDiscovery: o.NoPMTUD,
+		// No streams needed—just handshake
+	}
+}
+
+func (o ProbeOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return 1 * time.Second
+	}
+	return o.Timeout
+}
 
-	qconf := &quic.Config{
-		HandshakeIdleTimeout: timeout,
-		MaxIdleTimeout:       timeout,
-		KeepAlivePeriod:      0,
-		// No datagrams/streams needed—just handshake
+// Prober returns a precheck for TryCandidatesN that probes with o.
+func Prober(o ProbeOptions) func(ep string) error {
+	return func(ep string) error { return Probe(ep, o) }
+}
+
+// Probe runs ProbeTLS if o.TCP is set and ProbeQUIC otherwise.
+func Probe(ep string, o ProbeOptions) error {
+	if o.TCP {
+		return ProbeTLS(ep, o)
 	}
+	return ProbeQUIC(ep, o)
+}
 
-	conn, err := quic.DialAddr(ctx, ep, tconf, qconf)
+// ProbeQUIC attempts a QUIC handshake with ep ("host:port" or "[v6]:port")
+// and returns the dial error.
+func ProbeQUIC(ep string, o ProbeOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout())
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, ep, o.tlsConfig(ep), o.quicConfig())
 	if err != nil {
-		return false
+		return err
 	}
 	_ = conn.CloseWithError(0, "")
-	return true
+	return nil
+}
+
+// SNIResult is the outcome of probing one endpoint with one SNI.
+type SNIResult struct {
+	Endpoint string
+	SNI      string
+	Err      error
+}
+
+// ProbeSNIs probes ep with o once per SNI, in order.
+func ProbeSNIs(ep string, snis []string, o ProbeOptions) []SNIResult {
+	out := make([]SNIResult, 0, len(snis))
+	for _, name := range snis {
+		o.SNI = name
+		out = append(out, SNIResult{Endpoint: ep, SNI: name, Err: Probe(ep, o)})
+	}
+	return out
 }
 
 // ---- misc helpers ----
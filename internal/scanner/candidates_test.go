@@ -0,0 +1,51 @@
+package scanner
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTryCandidatesN(t *testing.T) {
+	errIdentity := errors.New("login failed")
+	results := map[string]error{
+		"a:443": &Rejection{Reason: ReasonHandshake},
+		"b:443": nil,
+		"c:443": &Rejection{Reason: ReasonIdentity, Err: errIdentity, Fatal: true},
+		"d:443": nil,
+	}
+	start := func(ep string) (func(), bool, error) {
+		err := results[ep]
+		return nil, err == nil, err
+	}
+	tests := []struct {
+		name       string
+		candidates []string
+		want       int
+		found      []string
+		reasons    []string
+		wantErr    error
+	}{
+		{"first working", []string{"a:443", "b:443", "d:443"}, 1, []string{"b:443"}, []string{ReasonHandshake, ReasonOK}, nil},
+		{"want two", []string{"a:443", "b:443", "d:443"}, 2, []string{"b:443", "d:443"}, []string{ReasonHandshake, ReasonOK, ReasonOK}, nil},
+		{"fatal stops the scan", []string{"a:443", "c:443", "d:443"}, 1, nil, []string{ReasonHandshake, ReasonIdentity}, errIdentity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reasons []string
+			found, err := TryCandidatesN(tt.candidates, tt.want, 0, nil, "", 0, start, func(a Attempt) {
+				reasons = append(reasons, a.Reason)
+			}, nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(found, tt.found) || !reflect.DeepEqual(reasons, tt.reasons) {
+				t.Errorf("found %v reasons %v, want %v %v", found, reasons, tt.found, tt.reasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"masque-plus/internal/fileutil"
+	"masque-plus/internal/logutil"
+)
+
+// EndpointList is a parsed endpoints file: concrete endpoints plus CIDR
+// ranges that still need expanding.
+type EndpointList struct {
+	Endpoints []string // "host:port" / "[v6]:port"
+	CIDRs4    []string
+	CIDRs6    []string
+}
+
+// Empty reports whether the list has no entries at all.
+func (l EndpointList) Empty() bool {
+	return len(l.Endpoints) == 0 && len(l.CIDRs4) == 0 && len(l.CIDRs6) == 0
+}
+
+// Merge appends other's entries to l.
+func (l *EndpointList) Merge(other EndpointList) {
+	l.Endpoints = append(l.Endpoints, other.Endpoints...)
+	l.CIDRs4 = append(l.CIDRs4, other.CIDRs4...)
+	l.CIDRs6 = append(l.CIDRs6, other.CIDRs6...)
+}
+
+// Filter keeps only endpoints of the requested IP version. Hostnames are
+// always kept since their family is only known after resolution.
+func (l EndpointList) Filter(ver int) EndpointList {
+	if ver == Any {
+		return l
+	}
+	out := EndpointList{}
+	for _, ep := range l.Endpoints {
+		host, _, _ := net.SplitHostPort(ep)
+		ip := net.ParseIP(host)
+		if ip == nil || (ver == V4) == (ip.To4() != nil) {
+			out.Endpoints = append(out.Endpoints, ep)
+		}
+	}
+	if ver == V4 {
+		out.CIDRs4 = l.CIDRs4
+	} else {
+		out.CIDRs6 = l.CIDRs6
+	}
+	return out
+}
+
+// ParseEndpointList reads one entry per line: host, host:port, IPv6,
+// [IPv6]:port or a CIDR. '#' starts a comment (whole-line or trailing).
+// Entries without a port get defaultPort.
+func ParseEndpointList(r io.Reader, defaultPort string) (EndpointList, error) {
+	var l EndpointList
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if ipnet, err := parseCIDR(line); err == nil {
+			if isIPv4Net(ipnet) {
+				l.CIDRs4 = append(l.CIDRs4, ipnet.String())
+			} else {
+				l.CIDRs6 = append(l.CIDRs6, ipnet.String())
+			}
+			continue
+		}
+
+		ep, err := normalizeEndpoint(line, defaultPort)
+		if err != nil {
+			return l, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if !seen[ep] {
+			seen[ep] = true
+			l.Endpoints = append(l.Endpoints, ep)
+		}
+	}
+	return l, sc.Err()
+}
+
+func normalizeEndpoint(s, defaultPort string) (string, error) {
+	// bare IPv6 without brackets/port
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(ip.String(), defaultPort), nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		if strings.Contains(s, "[") || strings.Count(s, ":") > 0 {
+			return "", fmt.Errorf("invalid endpoint %q", s)
+		}
+		host, port = s, defaultPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port in %q", s)
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid endpoint %q", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// LoadEndpointFile parses an endpoints file from disk.
+func LoadEndpointFile(path, defaultPort string) (EndpointList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return EndpointList{}, err
+	}
+	defer f.Close()
+	l, err := ParseEndpointList(f, defaultPort)
+	if err != nil {
+		return l, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
+
+// FetchEndpointList downloads an endpoints list and stores a copy at
+// cachePath. If the download fails, the cached copy is used instead so the
+// launcher keeps working offline.
+func FetchEndpointList(url, cachePath, defaultPort string, timeout time.Duration) (EndpointList, error) {
+	body, err := fetch(url, timeout)
+	if err == nil {
+		l, perr := ParseEndpointList(strings.NewReader(string(body)), defaultPort)
+		if perr != nil {
+			err = perr
+		} else {
+			if cachePath != "" {
+				if werr := fileutil.WriteAtomic(cachePath, body); werr != nil {
+					logutil.Warn("failed to cache endpoints list", map[string]string{"file": cachePath, "error": werr.Error()})
+				}
+			}
+			logutil.Info("endpoints list fetched", map[string]string{
+				"url":       url,
+				"endpoints": strconv.Itoa(len(l.Endpoints)),
+				"cidrs":     strconv.Itoa(len(l.CIDRs4) + len(l.CIDRs6)),
+			})
+			return l, nil
+		}
+	}
+
+	if cachePath == "" {
+		return EndpointList{}, err
+	}
+	l, cerr := LoadEndpointFile(cachePath, defaultPort)
+	if cerr != nil {
+		return EndpointList{}, fmt.Errorf("fetch failed (%v) and no usable cache (%v)", err, cerr)
+	}
+	logutil.Warn("endpoints list fetch failed; using cached copy", map[string]string{
+		"url":   url,
+		"cache": cachePath,
+		"error": err.Error(),
+	})
+	return l, nil
+}
+
+func fetch(url string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+}
@@ -0,0 +1,125 @@
+package scanner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEndpointList(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    EndpointList
+		wantErr string
+	}{
+		{
+			name: "all entry kinds",
+			in: `# header comment
+162.159.198.1
+162.159.198.2:8443   # trailing comment
+2606:4700:103::1
+[2606:4700:103::2]:500
+engage.cloudflareclient.com
+example.com:4500
+162.159.192.0/24
+2606:4700:d0::/48
+
+`,
+			want: EndpointList{
+				Endpoints: []string{
+					"162.159.198.1:443",
+					"162.159.198.2:8443",
+					"[2606:4700:103::1]:443",
+					"[2606:4700:103::2]:500",
+					"engage.cloudflareclient.com:443",
+					"example.com:4500",
+				},
+				CIDRs4: []string{"162.159.192.0/24"},
+				CIDRs6: []string{"2606:4700:d0::/48"},
+			},
+		},
+		{
+			name: "duplicates dropped",
+			in:   "1.1.1.1\n1.1.1.1:443\n1.1.1.1:8443\n",
+			want: EndpointList{Endpoints: []string{"1.1.1.1:443", "1.1.1.1:8443"}},
+		},
+		{name: "port out of range", in: "1.1.1.1\n1.1.1.1:70000\n", wantErr: "line 2"},
+		{name: "port not a number", in: "example.com:https", wantErr: "invalid port"},
+		{
+			name: "unbracketed v6 is a bare address",
+			in:   "2606:4700::1:443",
+			want: EndpointList{Endpoints: []string{"[2606:4700::1:443]:443"}},
+		},
+		{name: "broken brackets", in: "[2606:4700::1:443", wantErr: "invalid endpoint"},
+		{name: "empty host", in: ":443", wantErr: "invalid endpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseEndpointList(strings.NewReader(tt.in), "443")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	l := EndpointList{
+		Endpoints: []string{"1.1.1.1:443", "[2606:4700::1]:443", "example.com:443"},
+		CIDRs4:    []string{"10.0.0.0/8"},
+		CIDRs6:    []string{"fd00::/8"},
+	}
+	v4 := l.Filter(V4)
+	if !reflect.DeepEqual(v4.Endpoints, []string{"1.1.1.1:443", "example.com:443"}) || v4.CIDRs6 != nil {
+		t.Errorf("Filter(V4) = %+v", v4)
+	}
+	v6 := l.Filter(V6)
+	if !reflect.DeepEqual(v6.Endpoints, []string{"[2606:4700::1]:443", "example.com:443"}) || v6.CIDRs4 != nil {
+		t.Errorf("Filter(V6) = %+v", v6)
+	}
+}
+
+func TestFetchEndpointListCache(t *testing.T) {
+	up := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("162.159.198.1\n"))
+	}))
+	defer srv.Close()
+
+	cache := filepath.Join(t.TempDir(), "endpoints.txt")
+	l, err := FetchEndpointList(srv.URL, cache, "443", time.Second)
+	if err != nil || len(l.Endpoints) != 1 {
+		t.Fatalf("fetch = %+v, %v", l, err)
+	}
+	if st, err := os.Stat(cache); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && st.Mode().Perm() != 0600 {
+		t.Errorf("cache mode = %v, want 0600", st.Mode().Perm())
+	}
+
+	up = false
+	l, err = FetchEndpointList(srv.URL, cache, "443", time.Second)
+	if err != nil || len(l.Endpoints) != 1 || l.Endpoints[0] != "162.159.198.1:443" {
+		t.Errorf("cached fallback = %+v, %v", l, err)
+	}
+}
@@ -0,0 +1,103 @@
+package scanner
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"masque-plus/internal/logutil"
+)
+
+// DefaultStagger is the RFC 8305 "Connection Attempt Delay".
+const DefaultStagger = 250 * time.Millisecond
+
+// SplitFamilies separates endpoints into IPv4 and IPv6 lists, keeping order.
+// Hostname endpoints are returned separately since their family is unknown.
+func SplitFamilies(eps []string) (v4, v6, other []string) {
+	for _, ep := range eps {
+		host, _, err := net.SplitHostPort(ep)
+		ip := net.ParseIP(host)
+		switch {
+		case err != nil || ip == nil:
+			other = append(other, ep)
+		case ip.To4() != nil:
+			v4 = append(v4, ep)
+		default:
+			v6 = append(v6, ep)
+		}
+	}
+	return v4, v6, other
+}
+
+// RaceFamilies probes two candidate lists concurrently, happy-eyeballs
+// style (RFC 8305): first starts immediately, second after stagger, or as
+// soon as a probe in first fails. Each side probes its endpoints one at a
+// time with probe (e.g. QUICProbe), at most perFamily of them. The first
+// endpoint whose probe succeeds wins; ok is false if none did.
+func RaceFamilies(first, second []string, stagger time.Duration, probe func(ep string) error, perFamily int) (winner string, ok bool) {
+	if stagger <= 0 {
+		stagger = DefaultStagger
+	}
+	if perFamily > 0 {
+		if len(first) > perFamily {
+			first = first[:perFamily]
+		}
+		if len(second) > perFamily {
+			second = second[:perFamily]
+		}
+	}
+
+	done := make(chan struct{})
+	firstFailed := make(chan struct{})
+	won := make(chan string, 1)
+	var once, failOnce sync.Once
+	var wg sync.WaitGroup
+
+	race := func(eps []string, onFail func()) {
+		defer wg.Done()
+		for _, ep := range eps {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if probe(ep) == nil {
+				once.Do(func() {
+					won <- ep
+					close(done)
+				})
+				return
+			}
+			if onFail != nil {
+				onFail()
+			}
+		}
+	}
+
+	wg.Add(2)
+	go race(first, func() { failOnce.Do(func() { close(firstFailed) }) })
+	go func() {
+		select {
+		case <-time.After(stagger):
+		case <-firstFailed:
+		case <-done:
+			wg.Done()
+			return
+		}
+		race(second, nil)
+	}()
+
+	go func() {
+		wg.Wait()
+		once.Do(func() { close(done) })
+	}()
+
+	<-done
+	select {
+	case ep := <-won:
+		logutil.Info("happy eyeballs winner", map[string]string{"endpoint": ep})
+		return ep, true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,104 @@
+package scanner
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitFamilies(t *testing.T) {
+	v4, v6, other := SplitFamilies([]string{"1.1.1.1:443", "[2606:4700::1]:443", "engage.example:443", "1.0.0.1:500", "bad"})
+	if !reflect.DeepEqual(v4, []string{"1.1.1.1:443", "1.0.0.1:500"}) ||
+		!reflect.DeepEqual(v6, []string{"[2606:4700::1]:443"}) ||
+		!reflect.DeepEqual(other, []string{"engage.example:443", "bad"}) {
+		t.Errorf("SplitFamilies = %v %v %v", v4, v6, other)
+	}
+}
+
+// fakeProbe answers each endpoint after delay, failing unless it's in ok.
+type fakeProbe struct {
+	delay map[string]time.Duration
+	ok    map[string]bool
+}
+
+func (f fakeProbe) probe(ep string) error {
+	time.Sleep(f.delay[ep])
+	if f.ok[ep] {
+		return nil
+	}
+	return errors.New("handshake timed out")
+}
+
+func TestRaceFamilies(t *testing.T) {
+	const stagger = 200 * time.Millisecond
+	tests := []struct {
+		name      string
+		first     []string
+		second    []string
+		probe     fakeProbe
+		perFamily int
+		want      string
+		maxTime   time.Duration
+	}{
+		{
+			name:    "first wins before stagger",
+			first:   []string{"v4a"},
+			second:  []string{"v6a"},
+			probe:   fakeProbe{ok: map[string]bool{"v4a": true, "v6a": true}},
+			want:    "v4a",
+			maxTime: stagger / 2,
+		},
+		{
+			name:    "failure starts second early",
+			first:   []string{"v4a", "v4b"},
+			second:  []string{"v6a"},
+			probe:   fakeProbe{delay: map[string]time.Duration{"v4b": time.Second}, ok: map[string]bool{"v4b": true, "v6a": true}},
+			want:    "v6a",
+			maxTime: stagger / 2,
+		},
+		{
+			name:    "slow first loses after stagger",
+			first:   []string{"v4a"},
+			second:  []string{"v6a"},
+			probe:   fakeProbe{delay: map[string]time.Duration{"v4a": time.Second}, ok: map[string]bool{"v4a": true, "v6a": true}},
+			want:    "v6a",
+			maxTime: stagger + stagger/2,
+		},
+		{
+			name:    "later candidate in second",
+			first:   []string{"v4a"},
+			second:  []string{"v6a", "v6b"},
+			probe:   fakeProbe{ok: map[string]bool{"v6b": true}},
+			want:    "v6b",
+			maxTime: stagger / 2,
+		},
+		{
+			name:      "perFamily cuts the list",
+			first:     []string{"v4a", "v4b"},
+			second:    []string{"v6a", "v6b"},
+			probe:     fakeProbe{ok: map[string]bool{"v4b": true, "v6b": true}},
+			perFamily: 1,
+			maxTime:   stagger / 2,
+		},
+		{
+			name:    "empty second",
+			first:   []string{"v4a"},
+			probe:   fakeProbe{},
+			maxTime: stagger / 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			got, ok := RaceFamilies(tt.first, tt.second, stagger, tt.probe.probe, tt.perFamily)
+			elapsed := time.Since(start)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("RaceFamilies = %q, %v, want %q", got, ok, tt.want)
+			}
+			if elapsed > tt.maxTime {
+				t.Errorf("took %v, want at most %v", elapsed, tt.maxTime)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package scanner
+
+import (
+	"fmt"
+	"time"
+)
+
+// UDP payload bounds for DiscoverPacketSize, as enforced by quic-go.
+const (
+	MinPacketSize = 1200
+	MaxPacketSize = 1452
+)
+
+// DiscoverPacketSize returns the largest UDP payload between MinPacketSize
+// and MaxPacketSize that reliably reaches ep. The client pads its Initial
+// packets to the configured size, so a size counts as reliable when tries
+// handshakes in a row complete with it; the search is binary, to within
+// a few bytes.
+func DiscoverPacketSize(ep string, o ProbeOptions, tries int) (int, error) {
+	if tries <= 0 {
+		tries = 2
+	}
+	o.TCP = false
+	o.NoPMTUD = true
+	passes := func(size int) error {
+		o.InitialPacketSize = uint16(size)
+		for i := 0; i < tries; i++ {
+			if err := ProbeQUIC(ep, o); err != nil {
+				return err
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}
+	return searchPacketSize(passes)
+}
+
+// searchPacketSize binary-searches the largest size passes accepts,
+// given that sizes below it pass and sizes above it fail.
+func searchPacketSize(passes func(size int) error) (int, error) {
+	if err := passes(MaxPacketSize); err == nil {
+		return MaxPacketSize, nil
+	}
+	if err := passes(MinPacketSize); err != nil {
+		return 0, fmt.Errorf("no handshake at the minimum packet size %d: %w", MinPacketSize, err)
+	}
+	lo, hi := MinPacketSize, MaxPacketSize // lo passes, hi fails
+	for hi-lo > 4 {
+		mid := (lo + hi) / 2
+		if passes(mid) == nil {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
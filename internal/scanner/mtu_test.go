@@ -0,0 +1,45 @@
+package scanner
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSearchPacketSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int // largest size that gets through
+		wantErr bool
+	}{
+		{"everything passes", MaxPacketSize, false},
+		{"pppoe", 1444, false},
+		{"just above minimum", MinPacketSize + 3, false},
+		{"minimum only", MinPacketSize, false},
+		{"nothing passes", MinPacketSize - 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var probes int
+			got, err := searchPacketSize(func(size int) error {
+				probes++
+				if size > tt.limit {
+					return errors.New("handshake timed out")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// the search stops within 4 bytes, never above the limit
+			if got > tt.limit || tt.limit-got > 4 {
+				t.Errorf("searchPacketSize = %d, want within 4 below %d", got, tt.limit)
+			}
+			if probes > 10 {
+				t.Errorf("%d probes, want a binary search", probes)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package scanner
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// selfSigned returns a certificate for a throwaway P-256 key, like the
+// endpoints' certificates that usque pins by key.
+func selfSigned(t *testing.T) (tls.Certificate, crypto.PublicKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"consumer-masque.cloudflareclient.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, &key.PublicKey
+}
+
+func otherKey(t *testing.T) crypto.PublicKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &k.PublicKey
+}
+
+func TestProbePeerKey(t *testing.T) {
+	cert, key := selfSigned(t)
+
+	ql, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{TunnelALPN}}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ql.Close()
+	go func() {
+		for {
+			c, err := ql.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() { <-c.Context().Done() }()
+		}
+	}()
+
+	tl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	go func() {
+		for {
+			c, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				_ = c.(*tls.Conn).Handshake()
+				c.Close()
+			}(c)
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		tcp     bool
+		key     crypto.PublicKey
+		wantErr bool
+	}{
+		{"quic pinned key", false, key, false},
+		{"quic other key", false, otherKey(t), true},
+		{"quic no pin", false, nil, false},
+		{"h2 pinned key", true, key, false},
+		{"h2 other key", true, otherKey(t), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := TunnelProbe("consumer-masque.cloudflareclient.com", 1242, 0, 2*time.Second)
+			o.PeerKey = tt.key
+			ep := ql.Addr().String()
+			if tt.tcp {
+				o.TCP, o.ALPN = true, []string{"h2"}
+				ep = tl.Addr().String()
+			}
+			err := Probe(ep, o)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Probe = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), ErrPeerKeyMismatch.Error()) {
+				t.Errorf("err = %v, want %v", err, ErrPeerKeyMismatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"masque-plus/internal/fileutil"
+)
+
+// Report aggregates the attempts of one scan.
+type Report struct {
+	Time     time.Time      `json:"time"`
+	Total    int            `json:"total"`
+	OK       int            `json:"ok"`
+	Reasons  map[string]int `json:"reasons"`
+	Elapsed  ElapsedStats   `json:"elapsed"`
+	Ranges   []RangeReport  `json:"ranges"`
+	Attempts []AttemptInfo  `json:"attempts"`
+	SNIs     []SNIInfo      `json:"snis,omitempty"`
+}
+
+// SNIInfo is the JSON form of an SNIResult.
+type SNIInfo struct {
+	Endpoint string `json:"endpoint"`
+	SNI      string `json:"sni"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ElapsedStats summarizes how long attempts took, in milliseconds.
+type ElapsedStats struct {
+	MinMS    int64 `json:"min_ms"`
+	MedianMS int64 `json:"median_ms"`
+	MaxMS    int64 `json:"max_ms"`
+}
+
+// RangeReport is the breakdown for one scanned CIDR ("other" for endpoints
+// outside every range, e.g. from an endpoints list).
+type RangeReport struct {
+	CIDR    string         `json:"cidr"`
+	Total   int            `json:"total"`
+	OK      int            `json:"ok"`
+	Reasons map[string]int `json:"reasons"`
+	Elapsed ElapsedStats   `json:"elapsed"`
+}
+
+// AttemptInfo is the JSON form of an Attempt.
+type AttemptInfo struct {
+	Endpoint  string `json:"endpoint"`
+	CIDR      string `json:"cidr"`
+	Reason    string `json:"reason"`
+	Detail    string `json:"detail,omitempty"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+}
+
+// NewReport builds a report from attempts, attributing each to the first
+// of ranges that contains it.
+func NewReport(attempts []Attempt, ranges []string) *Report {
+	r := &Report{Time: time.Now(), Reasons: map[string]int{}}
+	byRange := map[string][]Attempt{}
+	var order []string
+	var all []time.Duration
+	for _, a := range attempts {
+		cidr, _ := locate(a.Endpoint, ranges)
+		if cidr == "" {
+			cidr = "other"
+		}
+		if _, ok := byRange[cidr]; !ok {
+			order = append(order, cidr)
+		}
+		byRange[cidr] = append(byRange[cidr], a)
+
+		r.Total++
+		if a.OK {
+			r.OK++
+		}
+		r.Reasons[a.Reason]++
+		all = append(all, a.Elapsed)
+		r.Attempts = append(r.Attempts, AttemptInfo{
+			Endpoint:  a.Endpoint,
+			CIDR:      cidr,
+			Reason:    a.Reason,
+			Detail:    a.Detail,
+			ElapsedMS: a.Elapsed.Milliseconds(),
+		})
+	}
+	r.Elapsed = elapsedStats(all)
+
+	for _, cidr := range order {
+		rr := RangeReport{CIDR: cidr, Reasons: map[string]int{}}
+		var el []time.Duration
+		for _, a := range byRange[cidr] {
+			rr.Total++
+			if a.OK {
+				rr.OK++
+			}
+			rr.Reasons[a.Reason]++
+			el = append(el, a.Elapsed)
+		}
+		rr.Elapsed = elapsedStats(el)
+		r.Ranges = append(r.Ranges, rr)
+	}
+	return r
+}
+
+// SNIInfos converts probe results to their JSON form.
+func SNIInfos(results []SNIResult) []SNIInfo {
+	out := make([]SNIInfo, 0, len(results))
+	for _, res := range results {
+		info := SNIInfo{Endpoint: res.Endpoint, SNI: res.SNI, OK: res.Err == nil}
+		if res.Err != nil {
+			info.Error = res.Err.Error()
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+func elapsedStats(d []time.Duration) ElapsedStats {
+	if len(d) == 0 {
+		return ElapsedStats{}
+	}
+	s := append([]time.Duration(nil), d...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return ElapsedStats{
+		MinMS:    s[0].Milliseconds(),
+		MedianMS: s[len(s)/2].Milliseconds(),
+		MaxMS:    s[len(s)-1].Milliseconds(),
+	}
+}
+
+// Print writes the report as plain-text tables.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "scan report: %d tried, %d ok, elapsed min/median/max %s\n",
+		r.Total, r.OK, r.Elapsed)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REASON\tCOUNT")
+	for _, k := range sortedKeys(r.Reasons) {
+		fmt.Fprintf(tw, "%s\t%d\n", k, r.Reasons[k])
+	}
+	_ = tw.Flush()
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CIDR\tTRIED\tOK\tMIN/MEDIAN/MAX\tFAILURES")
+	for _, rr := range r.Ranges {
+		var fails string
+		for _, k := range sortedKeys(rr.Reasons) {
+			if k == ReasonOK {
+				continue
+			}
+			if fails != "" {
+				fails += " "
+			}
+			fails += fmt.Sprintf("%s=%d", k, rr.Reasons[k])
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", rr.CIDR, rr.Total, rr.OK, rr.Elapsed, fails)
+	}
+	_ = tw.Flush()
+
+	if len(r.SNIs) > 0 {
+		fmt.Fprintln(w)
+		PrintSNIs(w, r.SNIs)
+	}
+}
+
+// PrintSNIs writes SNI probe results as a table.
+func PrintSNIs(w io.Writer, snis []SNIInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tSNI\tRESULT")
+	for _, s := range snis {
+		res := "ok"
+		if !s.OK {
+			res = s.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Endpoint, s.SNI, res)
+	}
+	_ = tw.Flush()
+}
+
+func (e ElapsedStats) String() string {
+	return fmt.Sprintf("%dms/%dms/%dms", e.MinMS, e.MedianMS, e.MaxMS)
+}
+
+// Save writes the report as JSON.
+func (r *Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(path, data)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,64 @@
+package scanner
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNewReport(t *testing.T) {
+	ranges := []string{"162.159.192.0/24", "2606:4700:d0::/48"}
+	attempts := []Attempt{
+		{Endpoint: "162.159.192.1:443", OK: true, Reason: "ok", Elapsed: 30 * time.Millisecond},
+		{Endpoint: "162.159.192.2:443", Reason: "timeout", Elapsed: 10 * time.Millisecond},
+		{Endpoint: "[2606:4700:d0::1]:443", Reason: "timeout", Elapsed: 20 * time.Millisecond},
+		{Endpoint: "example.com:443", Reason: "refused", Elapsed: 40 * time.Millisecond},
+	}
+	r := NewReport(attempts, ranges)
+	if r.Total != 4 || r.OK != 1 || r.Reasons["timeout"] != 2 {
+		t.Errorf("totals = %d/%d %v", r.OK, r.Total, r.Reasons)
+	}
+	if r.Elapsed != (ElapsedStats{MinMS: 10, MedianMS: 30, MaxMS: 40}) {
+		t.Errorf("elapsed = %+v", r.Elapsed)
+	}
+	want := []struct {
+		cidr      string
+		total, ok int
+	}{
+		{"162.159.192.0/24", 2, 1},
+		{"2606:4700:d0::/48", 1, 0},
+		{"other", 1, 0},
+	}
+	if len(r.Ranges) != len(want) {
+		t.Fatalf("ranges = %+v", r.Ranges)
+	}
+	for i, w := range want {
+		got := r.Ranges[i]
+		if got.CIDR != w.cidr || got.Total != w.total || got.OK != w.ok {
+			t.Errorf("range %d = %s %d/%d, want %s %d/%d", i, got.CIDR, got.OK, got.Total, w.cidr, w.ok, w.total)
+		}
+	}
+}
+
+func TestReportSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	r := NewReport([]Attempt{{Endpoint: "1.1.1.1:443", OK: true, Reason: "ok"}}, nil)
+	if err := r.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && st.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", st.Mode().Perm())
+	}
+	data, _ := os.ReadFile(path)
+	var got Report
+	if err := json.Unmarshal(data, &got); err != nil || got.OK != 1 {
+		t.Errorf("saved report = %+v, %v", got, err)
+	}
+}
@@ -129,6 +129,13 @@ func ScanEndpoints(endpoints []string, opts ...Option) []Result {
 	return results
 }
 
+// ProbeTLS is the TCP counterpart of ProbeQUIC: a TLS handshake with ep
+// using o's SNI and ALPN (e.g. "h2" for the HTTP/2 transport).
+func ProbeTLS(ep string, o ProbeOptions) error {
+	_, err := tryEndpointScan(ep, Options{PerIPTimeout: o.timeout(), TLSConfig: o.tlsConfig(ep)})
+	return err
+}
+
 func transportName(o Options) string {
 	if o.UseQUIC {
 		return "quic"
@@ -182,6 +189,5 @@ func cloneTLS(c *tls.Config) *tls.Config {
 	if c == nil {
 		return &tls.Config{}
 	}
-	cp := *c
-	return &cp
+	return c.Clone()
 }
@@ -0,0 +1,168 @@
+package scanner
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"masque-plus/internal/fileutil"
+)
+
+// PortStat counts outcomes for one port within one scanned range, or for
+// one subnet.
+type PortStat struct {
+	OK   int `json:"ok"`
+	Fail int `json:"fail"`
+}
+
+// score is the smoothed success rate (Laplace), so unseen ports sit at 0.5.
+func (p *PortStat) score() float64 {
+	if p == nil {
+		return 0.5
+	}
+	return float64(p.OK+1) / float64(p.OK+p.Fail+2)
+}
+
+// Stats is the scan history persisted between runs.
+type Stats struct {
+	// Ports maps a CIDR range to per-port outcomes.
+	Ports map[string]map[string]*PortStat `json:"ports"`
+	// Subnets maps a network ID to per-/24 and per-/64 outcomes, used by
+	// the adaptive scanner.
+	Subnets map[string]map[string]*PortStat `json:"subnets,omitempty"`
+	// Seen is when each network in Subnets was last scanned (Unix seconds);
+	// networks not seen for maxNetworkAge are dropped on Save.
+	Seen map[string]int64 `json:"seen,omitempty"`
+
+	// Network selects the Subnets entry for this run.
+	Network string `json:"-"`
+	// Adaptive enables per-subnet recording; without it only Ports is kept.
+	Adaptive bool `json:"-"`
+
+	path  string
+	dirty bool // something was recorded since loading
+	mu    sync.Mutex
+}
+
+// LoadStats reads the stats file; a missing or unreadable file yields empty stats.
+func LoadStats(path string) *Stats {
+	s := &Stats{path: path}
+	if data, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(data, s)
+	}
+	if s.Ports == nil {
+		s.Ports = map[string]map[string]*PortStat{}
+	}
+	if s.Subnets == nil {
+		s.Subnets = map[string]map[string]*PortStat{}
+	}
+	if s.Seen == nil {
+		s.Seen = map[string]int64{}
+	}
+	// files written before Seen existed start aging now
+	for n := range s.Subnets {
+		if s.Seen[n] == 0 {
+			s.Seen[n] = time.Now().Unix()
+		}
+	}
+	return s
+}
+
+// Save writes the stats back to the file they were loaded from, if
+// anything was recorded, so runs that never scan leave no file behind.
+func (s *Stats) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	s.prune(time.Now())
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(s.path, data)
+}
+
+// Record stores the outcome for ep under the first of ranges containing it,
+// and, in adaptive mode, under its subnet on the current network.
+func (s *Stats) Record(ep string, ranges []string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sn := subnetOf(ep); s.Adaptive && sn != "" {
+		subs := s.subnets()
+		if subs[sn] == nil {
+			subs[sn] = &PortStat{}
+		}
+		subs[sn].add(ok)
+		s.Seen[s.Network] = time.Now().Unix()
+		s.dirty = true
+	}
+
+	cidr, port := locate(ep, ranges)
+	if cidr == "" {
+		return
+	}
+	m := s.Ports[cidr]
+	if m == nil {
+		m = map[string]*PortStat{}
+		s.Ports[cidr] = m
+	}
+	ps := m[port]
+	if ps == nil {
+		ps = &PortStat{}
+		m[port] = ps
+	}
+	ps.add(ok)
+	s.dirty = true
+}
+
+func (p *PortStat) add(ok bool) {
+	if ok {
+		p.OK++
+	} else {
+		p.Fail++
+	}
+}
+
+// Prioritize stable-sorts candidates so ports with a better track record in
+// their range come first. Relative order (e.g. a prior shuffle) is kept
+// among equally scored candidates.
+func (s *Stats) Prioritize(candidates []string, ranges []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score := make(map[string]float64, len(candidates))
+	for _, ep := range candidates {
+		cidr, port := locate(ep, ranges)
+		score[ep] = s.Ports[cidr][port].score()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return score[candidates[i]] > score[candidates[j]]
+	})
+}
+
+// locate returns the range containing ep's host and ep's port.
+func locate(ep string, ranges []string) (string, string) {
+	host, port, err := net.SplitHostPort(ep)
+	if err != nil {
+		return "", ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", port
+	}
+	for _, r := range ranges {
+		if n, err := parseCIDR(r); err == nil && n.Contains(ip) {
+			return strings.TrimSpace(r), port
+		}
+	}
+	return "", port
+}
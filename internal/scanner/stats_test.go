@@ -0,0 +1,59 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestStatsSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan_stats.json")
+	s := LoadStats(path)
+	s.Record("1.1.1.1:443", []string{"162.159.192.0/24"}, true) // outside every range
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Save with nothing recorded wrote the file (stat err %v)", err)
+	}
+
+	s.Record("162.159.192.5:443", []string{"162.159.192.0/24"}, true)
+	s.Record("162.159.192.6:8443", []string{"162.159.192.0/24"}, false)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && st.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", st.Mode().Perm())
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*.tmp")); len(matches) != 0 {
+		t.Errorf("temp files left: %v", matches)
+	}
+
+	got := LoadStats(path)
+	ports := got.Ports["162.159.192.0/24"]
+	if ports["443"] == nil || ports["443"].OK != 1 || ports["8443"] == nil || ports["8443"].Fail != 1 {
+		t.Errorf("reloaded ports = %+v", ports)
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	ranges := []string{"162.159.192.0/24"}
+	s := LoadStats("")
+	for i := 0; i < 3; i++ {
+		s.Record("162.159.192.1:8443", ranges, true)
+		s.Record("162.159.192.1:443", ranges, false)
+	}
+	cands := []string{"162.159.192.9:443", "162.159.192.9:2408", "162.159.192.9:8443"}
+	s.Prioritize(cands, ranges)
+	want := []string{"162.159.192.9:8443", "162.159.192.9:2408", "162.159.192.9:443"}
+	for i := range want {
+		if cands[i] != want[i] {
+			t.Fatalf("Prioritize = %v, want %v", cands, want)
+		}
+	}
+}
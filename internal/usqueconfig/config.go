@@ -0,0 +1,198 @@
+package usqueconfig
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"masque-plus/internal/fileutil"
+)
+
+// Config is usque's config.json. Keys masque-plus doesn't know about are
+// kept in Extra and written back unchanged.
+type Config struct {
+	PrivateKey     string `json:"private_key"`      // base64 DER EC private key
+	EndpointV4     string `json:"endpoint_v4"`      // IPv4 address of the MASQUE endpoint
+	EndpointV6     string `json:"endpoint_v6"`      // IPv6 address of the MASQUE endpoint
+	EndpointV4Port string `json:"endpoint_v4_port"` // written by masque-plus
+	EndpointV6Port string `json:"endpoint_v6_port"` // written by masque-plus
+	EndpointPubKey string `json:"endpoint_pub_key"` // PEM public key of the endpoint
+	License        string `json:"license"`
+	ID             string `json:"id"`
+	AccessToken    string `json:"access_token"`
+	IPv4           string `json:"ipv4"` // tunnel interface address
+	IPv6           string `json:"ipv6"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// knownKeys must match the json tags above.
+var knownKeys = []string{
+	"private_key", "endpoint_v4", "endpoint_v6", "endpoint_v4_port", "endpoint_v6_port",
+	"endpoint_pub_key", "license", "id", "access_token", "ipv4", "ipv6",
+}
+
+// port keys are only written when set, as before the typed model.
+var omitEmptyKeys = map[string]bool{"endpoint_v4_port": true, "endpoint_v6_port": true}
+
+type plain Config
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, k := range knownKeys {
+		delete(all, k)
+	}
+	if len(all) > 0 {
+		c.Extra = all
+	} else {
+		c.Extra = nil
+	}
+	return nil
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	known, err := json.Marshal(plain(c))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]json.RawMessage, len(knownKeys)+len(c.Extra))
+	for k, v := range c.Extra {
+		out[k] = v
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(known, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		if omitEmptyKeys[k] && string(v) == `""` {
+			continue
+		}
+		out[k] = v
+	}
+	return json.Marshal(out)
+}
+
+// Load reads and parses a config file. It does not validate it.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks that the identity is usable: the private key parses, the
+// endpoint key is PEM, and all addresses and ports are well formed.
+func (c *Config) Validate() error {
+	if c.PrivateKey == "" {
+		return errors.New("private_key is missing")
+	}
+	der, err := base64.StdEncoding.DecodeString(c.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private_key is not base64: %w", err)
+	}
+	if _, err := x509.ParseECPrivateKey(der); err != nil {
+		if _, err2 := x509.ParsePKCS8PrivateKey(der); err2 != nil {
+			return fmt.Errorf("private_key: %w", err)
+		}
+	}
+
+	if c.EndpointPubKey == "" {
+		return errors.New("endpoint_pub_key is missing")
+	}
+	if b, _ := pem.Decode([]byte(c.EndpointPubKey)); b == nil {
+		return errors.New("endpoint_pub_key is not PEM")
+	}
+
+	if err := checkIP("endpoint_v4", c.EndpointV4, true); err != nil {
+		return err
+	}
+	if err := checkIP("endpoint_v6", c.EndpointV6, false); err != nil {
+		return err
+	}
+	if err := checkIP("ipv4", c.IPv4, true); err != nil {
+		return err
+	}
+	if err := checkIP("ipv6", c.IPv6, false); err != nil {
+		return err
+	}
+	if err := checkPort("endpoint_v4_port", c.EndpointV4Port); err != nil {
+		return err
+	}
+	return checkPort("endpoint_v6_port", c.EndpointV6Port)
+}
+
+// PeerKey parses endpoint_pub_key: the public key the endpoint's
+// certificate carries, which usque pins instead of checking a CA chain.
+func (c *Config) PeerKey() (crypto.PublicKey, error) {
+	b, _ := pem.Decode([]byte(c.EndpointPubKey))
+	if b == nil {
+		return nil, errors.New("endpoint_pub_key is not PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint_pub_key: %w", err)
+	}
+	return key, nil
+}
+
+func checkIP(key, v string, v4 bool) error {
+	if v == "" {
+		return nil
+	}
+	ip := net.ParseIP(v)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return fmt.Errorf("%s: invalid address %q", key, v)
+	}
+	return nil
+}
+
+func checkPort(key, v string) error {
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%s: invalid port %q", key, v)
+	}
+	return nil
+}
+
+// SetEndpoint stores ip:port in the v4 or v6 fields depending on the family.
+func (c *Config) SetEndpoint(ip net.IP, port string) {
+	if ip.To4() != nil {
+		c.EndpointV4 = ip.String()
+		c.EndpointV4Port = port
+		return
+	}
+	c.EndpointV6 = ip.String()
+	c.EndpointV6Port = port
+}
+
+// Save writes the config atomically (temp file + rename) with 0600
+// permissions, since it contains the private key.
+func (c *Config) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteAtomic(path, data)
+}
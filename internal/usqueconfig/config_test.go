@@ -0,0 +1,177 @@
+package usqueconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func testKeys(t *testing.T) (priv, pub string) {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+}
+
+func TestRoundTripKeepsExtra(t *testing.T) {
+	in := `{
+		"private_key": "a2V5",
+		"endpoint_v4": "162.159.198.1",
+		"endpoint_v6": "2606:4700:103::1",
+		"endpoint_pub_key": "pem",
+		"license": "lic",
+		"id": "dev",
+		"access_token": "tok",
+		"ipv4": "172.16.0.2",
+		"ipv6": "2606:4700:110::2",
+		"future_key": {"nested": [1, 2]},
+		"flag": true
+	}`
+	var c Config
+	if err := json.Unmarshal([]byte(in), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.EndpointV4 != "162.159.198.1" || c.AccessToken != "tok" {
+		t.Errorf("known fields not parsed: %+v", c)
+	}
+	if len(c.Extra) != 2 {
+		t.Fatalf("Extra = %v, want future_key and flag", c.Extra)
+	}
+
+	out, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want map[string]any
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(in), &want); err != nil {
+		t.Fatal(err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("round trip changed the config:\n got %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+func TestPortsOnlyWrittenWhenSet(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		key  string
+	}{
+		{"v4", "162.159.198.2", "endpoint_v4_port"},
+		{"v6", "2606:4700:103::2", "endpoint_v6_port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			out, _ := json.Marshal(c)
+			var m map[string]json.RawMessage
+			_ = json.Unmarshal(out, &m)
+			if _, ok := m[tt.key]; ok {
+				t.Fatalf("%s written while empty", tt.key)
+			}
+
+			c.SetEndpoint(net.ParseIP(tt.ip), "8443")
+			out, _ = json.Marshal(c)
+			m = nil
+			_ = json.Unmarshal(out, &m)
+			if string(m[tt.key]) != `"8443"` {
+				t.Errorf("%s = %s, want \"8443\"", tt.key, m[tt.key])
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	priv, pub := testKeys(t)
+	valid := func() *Config {
+		return &Config{PrivateKey: priv, EndpointPubKey: pub, EndpointV4: "162.159.198.1", EndpointV6: "2606:4700:103::1", IPv4: "172.16.0.2"}
+	}
+	tests := []struct {
+		name    string
+		mutate  func(*Config)
+		wantErr bool
+	}{
+		{"valid", func(*Config) {}, false},
+		{"missing key", func(c *Config) { c.PrivateKey = "" }, true},
+		{"key not base64", func(c *Config) { c.PrivateKey = "%%%" }, true},
+		{"key not DER", func(c *Config) { c.PrivateKey = "a2V5" }, true},
+		{"pub key not PEM", func(c *Config) { c.EndpointPubKey = "nope" }, true},
+		{"v6 in v4 field", func(c *Config) { c.EndpointV4 = "2606:4700::1" }, true},
+		{"v4 in v6 field", func(c *Config) { c.EndpointV6 = "1.1.1.1" }, true},
+		{"bad port", func(c *Config) { c.EndpointV4Port = "70000" }, true},
+		{"good port", func(c *Config) { c.EndpointV4Port = "443" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.mutate(c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	c := &Config{PrivateKey: "a2V5", Extra: map[string]json.RawMessage{"x": json.RawMessage(`1`)}}
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && st.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", st.Mode().Perm())
+	}
+	got, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PrivateKey != "a2V5" || string(got.Extra["x"]) != "1" {
+		t.Errorf("Load = %+v", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*.tmp")); len(matches) != 0 {
+		t.Errorf("temp files left: %v", matches)
+	}
+}
+
+func TestPeerKey(t *testing.T) {
+	_, pub := testKeys(t)
+	c := &Config{EndpointPubKey: pub}
+	if k, err := c.PeerKey(); err != nil || k == nil {
+		t.Errorf("PeerKey = %v, %v", k, err)
+	}
+	for _, bad := range []string{"", "nope", "-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n"} {
+		c.EndpointPubKey = bad
+		if _, err := c.PeerKey(); err == nil {
+			t.Errorf("PeerKey(%q) succeeded", bad)
+		}
+	}
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"bufio"
+	"crypto"
 	"crypto/rand"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"math/big"
@@ -14,11 +15,23 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"masque-plus/internal/dnsserver"
+	"masque-plus/internal/frontend"
 	"masque-plus/internal/httpcheck"
+	"masque-plus/internal/identity"
 	"masque-plus/internal/logutil"
+	"masque-plus/internal/netutil"
+	"masque-plus/internal/netwatch"
+	"masque-plus/internal/pac"
+	"masque-plus/internal/register"
+	"masque-plus/internal/router"
 	"masque-plus/internal/scanner"
+	"masque-plus/internal/usqueconfig"
+
+	"golang.org/x/net/proxy"
 )
 
 var (
@@ -44,6 +57,14 @@ var (
 	defaultConnectTimeout = 15 * time.Minute
 	defaultTestURL        = "https://connectivity.cloudflareclient.com/cdn-cgi/trace"
 	defaultSNI            = "consumer-masque.cloudflareclient.com"
+	defaultDNSUpstream    = "https://cloudflare-dns.com/dns-query"
+	defaultScanPort       = "443"
+	defaultScanStats      = "./scan_stats.json"
+	defaultEndpointsCache = "./endpoints_cache.txt"
+
+	// backoff between retries when a tunnel that worked before fails to start
+	startRetryMin = 2 * time.Second
+	startRetryMax = time.Minute
 )
 
 var (
@@ -60,10 +81,27 @@ var (
 	username          string
 	reconnectDelay    = 1 * time.Second
 	sni               = defaultSNI
+	transport         = transportQUIC
 	useIpv6           bool
+	endpointKey       crypto.PublicKey // endpoint_pub_key of the identity in use; prechecks pin it
+
+	acceptTOS       bool
+	registerTimeout = 60 * time.Second
+	registerRetries = 3
+	registerNative  bool
+	registerAPI     = register.DefaultAPI
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		runIdentityCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBenchCmd(os.Args[2:])
+		return
+	}
+
 	endpoint := flag.String("endpoint", "", "Endpoint to connect (IPv4, IPv6, domain; host or host:Port; for IPv6 with port use [IPv6]:Port)")
 	bind := flag.String("bind", defaultBind, "IP:Port to bind SOCKS proxy")
 	renew := flag.Bool("renew", false, "Force renewal of config even if config.json exists")
@@ -80,8 +118,49 @@ func main() {
 	scanMax := flag.Int("scan-max", 30, "Maximum number of endpoints to try during scan")
 	scanVerboseChild := flag.Bool("scan-verbose-child", false, "Print MASQUE child process logs during scan")
 	scanTunnelFailLimit := flag.Int("scan-tunnel-fail-limit", 2, "Number of 'Failed to connect tunnel' occurrences before skipping an endpoint")
+	scanPorts := flag.String("scan-ports", "", "comma-separated ports to scan (default 443), e.g. 443,500,1701,4500,4443,8443,8095")
+	scanPortStrategy := flag.String("scan-port-strategy", scanner.PortRandom, "How ports are combined with IPs: random (one port per IP) or cross (every IP with every port)")
+	scanStats := flag.String("scan-stats", defaultScanStats, "File recording which ports succeed per range, used to prioritize later scans (empty disables)")
+	scanSample := flag.Int("scan-sample", 0, "Random IPs to sample per CIDR (0: every IPv4 address, 1024 per IPv6 range)")
+	scanStratify4 := flag.Int("scan-stratify4", 0, "Spread IPv4 samples over sub-prefixes of this length, e.g. 28 (0 disables)")
+	scanStratify6 := flag.Int("scan-stratify6", 64, "Spread IPv6 samples over sub-prefixes of this length, e.g. 64 or 120 (0 disables)")
+	scanSeed := flag.Int64("scan-seed", 0, "Seed for sampling and shuffling, for reproducible scans (0: random)")
+	endpointsFile := flag.String("endpoints-file", "", "File with endpoints to scan, one per line (host, host:port, [v6]:port or CIDR; '#' comments); implies --scan")
+	endpointsURL := flag.String("endpoints-url", "", "URL of an endpoints list fetched at startup (same format as --endpoints-file); implies --scan")
+	endpointsCache := flag.String("endpoints-cache", defaultEndpointsCache, "Local copy of --endpoints-url used when the download fails")
+	dualStack := flag.Bool("dual-stack", false, "With --scan and neither -4 nor -6, race IPv4 and IPv6 candidates (happy eyeballs) and remember the reliable family per network")
+	dualStackStagger := flag.Duration("dual-stack-stagger", scanner.DefaultStagger, "Head start of the preferred family in --dual-stack races")
+	resolverURL := flag.String("resolver", "", "Resolver for hostname endpoints: https://, tls://, tcp:// or udp:// URL (default: system resolver)")
+	resolveInterval := flag.Duration("resolve-interval", 5*time.Minute, "Re-resolve a hostname endpoint this often and switch when its record changes (0 disables)")
+	netWatch := flag.Bool("net-watch", true, "Reconnect (or rescan, with --scan) when the local network changes and the tunnel stops working")
+	netDebounce := flag.Duration("net-debounce", 3*time.Second, "Quiet period after a network change before the tunnel is checked")
+	var checkSpecs listFlag
+	flag.Var(&checkSpecs, "check", "Connectivity check, repeatable: warp=URL, http=URL [status=N] [body=REGEX, last], tcp=HOST:PORT, dns=SERVER [name=NAME], throughput=URL [min=KBPS] [bytes=N] (default: warp on --test-url)")
+	checkMode := flag.String("check-mode", "all", "How --check results combine: all (every check must pass) or any")
+	checkInterval := flag.Duration("check-interval", 0, "Run the checks through the tunnel this often and reconnect when they keep failing (0 disables)")
+	checkFailures := flag.Int("check-failures", 2, "Consecutive failed --check-interval rounds before reconnecting")
+	scanBench := flag.Int("scan-bench", 0, "Benchmark up to N working endpoints during --scan and pick the fastest (0: take the first that works)")
+	benchOpts := benchFlags(flag.CommandLine)
+	scanRequire := flag.String("scan-require", requireWarp, "What a scanned endpoint must pass to be selected: warp (--test-url reports warp=on), http (--test-url answers 200) or connect (tunnel up)")
+	scanReport := flag.String("scan-report", "", "Write the scan report (per-reason and per-CIDR breakdown, every attempt) to this JSON file")
+	scanBlockThreshold := flag.Int("scan-block-threshold", 5, "Treat a family/port as blocked after this many QUIC prechecks in a row time out or hit ICMP unreachable, and stop probing it (0 disables)")
+	scanFallbackPorts := flag.String("scan-fallback-ports", strings.Join(scanner.DefaultFallbackPorts, ","), "Comma-separated ports to retry addresses on once their port looks blocked (empty disables)")
+	scanAdaptive := flag.Bool("scan-adaptive", false, "Learn per-/24 and per-/64 success rates on this network (kept in --scan-stats) and try productive subnets first")
 	scanOrdered := flag.Bool("scan-ordered", false, "Scan candidates in CIDR order (disable shuffling)")
 	testURL := flag.String("test-url", defaultTestURL, "URL used to verify connectivity over the SOCKS tunnel")
+	rulesFile := flag.String("rules", "", "Split-tunnel rules file; enables the SOCKS/HTTP front-end on --bind")
+	rulesReload := flag.Duration("rules-reload", 5*time.Second, "How often to check the rules/GeoIP files for changes (0 disables)")
+	geoipFile := flag.String("geoip-file", "", "CSV GeoIP database (CIDR,CC or START,END,CC) used by geoip rules")
+	pacBind := flag.String("pac-bind", "", "IP:Port to serve a PAC file for browser auto-configuration (disabled if empty)")
+	pacBypass := flag.String("pac-bypass", "", "comma-separated domains/CIDRs that the PAC file sends DIRECT")
+	dnsBind := flag.String("dns-bind", "", "IP:Port for a local DNS server (UDP+TCP) that resolves through the tunnel (disabled if empty)")
+	dnsUpstream := flag.String("dns-upstream", defaultDNSUpstream, "comma-separated upstreams for --dns-bind (https://, tls://, tcp://, udp://)")
+	dnsRoute := flag.String("dns-route", "", "comma-separated per-domain upstreams for --dns-bind, e.g. example.ir=udp://192.168.1.1:53")
+	dnsCache := flag.Int("dns-cache", 1024, "Number of answers cached by --dns-bind (0 disables)")
+	identityName := flag.String("identity", "", "Named identity to use (registered into --identity-dir if missing)")
+	identityRotate := flag.String("identity-rotate", rotateNone, "Identity rotation: none, instance (next one per start) or failure (next one when rejected)")
+	identityDir := flag.String("identity-dir", identity.DefaultDir, "Directory holding named identities")
+	backendBind := flag.String("backend-bind", "", "IP:Port for the usque SOCKS backend when --rules is set (default: random loopback port)")
 
 	// usque-specific flags
 	flag.IntVar(&connectPort, "connect-port", connectPort, "Used port for MASQUE connection")
@@ -91,25 +170,40 @@ func main() {
 	flag.DurationVar(&keepalivePeriod, "keepalive-period", keepalivePeriod, "Keepalive period for MASQUE connection")
 	flag.BoolVar(&localDns, "local-dns", localDns, "Don't use the tunnel for DNS queries")
 	flag.IntVar(&mtu, "mtu", mtu, "MTU for MASQUE connection")
+	flag.BoolVar(&mtuAuto, "mtu-auto", false, "Discover the largest QUIC packet size that reaches the endpoint, size --initial-packet-size and --mtu to it, and lower the MTU whenever usque reports a datagram frame too large")
 	flag.BoolVar(&noTunnelIpv4, "no-tunnel-ipv4", noTunnelIpv4, "Disable IPv4 inside the MASQUE tunnel")
 	flag.BoolVar(&noTunnelIpv6, "no-tunnel-ipv6", noTunnelIpv6, "Disable IPv6 inside the MASQUE tunnel")
 	flag.StringVar(&password, "password", password, "Password for proxy authentication")
 	flag.StringVar(&username, "username", username, "Username for proxy authentication")
 	flag.DurationVar(&reconnectDelay, "reconnect-delay", reconnectDelay, "Delay between reconnect attempts")
 	flag.StringVar(&sni, "sni", sni, "SNI address to use for MASQUE connection")
+	transportFlag := flag.String("transport", transportAuto, "Tunnel transport: quic (HTTP/3 over UDP), h2 (HTTP/2 over TCP/TLS) or auto (quic, scanning again over h2 when no QUIC precheck gets through)")
+	sniListFlag := flag.String("sni-list", "", "Comma-separated SNIs, or a file with one per line, to probe every endpoint with; the first working one is used")
 	flag.BoolVar(&useIpv6, "ipv6", useIpv6, "Use IPv6 for MASQUE connection")
 
+	// registration flags
+	flag.BoolVar(&acceptTOS, "accept-tos", acceptTOS, "Accept the Cloudflare terms of service when registering (otherwise you are asked)")
+	flag.DurationVar(&registerTimeout, "register-timeout", registerTimeout, "Timeout for one registration attempt")
+	flag.IntVar(&registerRetries, "register-retries", registerRetries, "Retries for rate-limited, network or timed-out registrations")
+	flag.BoolVar(&registerNative, "register-native", registerNative, "Register directly against the API instead of running `usque register`")
+	flag.StringVar(&registerAPI, "register-api", registerAPI, "Base URL of the registration API (for --register-native)")
+
 	flag.Parse()
 
 	_ = rtt
 	_ = reserved
-	_ = testURL
 
+	prevState, stateErr := LoadState()
+	fromState := false
 	if *endpoint == "" && !*scan {
-		if st, err := LoadState(); err == nil {
+		if stateErr == nil {
 			fmt.Println("Loading previous state...")
-			*endpoint = st.Endpoint
-			*bind = st.Socks
+			*endpoint = prevState.Endpoint
+			*bind = prevState.Socks
+			if sni == defaultSNI && prevState.SNI != "" {
+				sni = prevState.SNI
+			}
+			fromState = true
 		}
 	}
 	
@@ -117,220 +211,665 @@ func main() {
 	if *v4Flag && *v6Flag {
 		logErrorAndExit("both -4 and -6 provided")
 	}
+	switch *transportFlag {
+	case transportQUIC, transportAuto:
+	case transportH2:
+		transport = transportH2
+	default:
+		logErrorAndExit(fmt.Sprintf("invalid --transport %q (want quic, h2 or auto)", *transportFlag))
+	}
+	sniList, err := loadSNIList(*sniListFlag)
+	if err != nil {
+		logErrorAndExit(fmt.Sprintf("invalid --sni-list: %v", err))
+	}
+	if *endpointsFile != "" || *endpointsURL != "" {
+		*scan = true
+	}
 	if *endpoint == "" && !*scan {
 		logErrorAndExit("--endpoint is required")
 	}
 
-	configFile := defaultConfigFile
+	setupResolver(*resolverURL)
+	switch *scanRequire {
+	case requireWarp, requireHTTP, requireConnect:
+	default:
+		logErrorAndExit(fmt.Sprintf("invalid --scan-require %q (want warp, http or connect)", *scanRequire))
+	}
+	checks := buildChecks(checkSpecs, *checkMode, *testURL)
+
+	pool := identity.Pool{Dir: *identityDir}
+	configFile, idName := selectIdentity(pool, *identityName, *identityRotate, prevState.Identity)
 	usquePath := defaultUsquePath
+	if idName != "" {
+		logInfo("using identity", map[string]string{"name": idName, "config": configFile})
+	}
 
 	logInfo("running in masque mode", nil)
 
-	if *scan {
-		logInfo("scanner mode enabled", nil)
-		candidates := buildCandidatesFromFlags(*v6Flag, *v4Flag, *range4, *range6)
-
-		if len(candidates) > 1 && !*scanOrdered {
-			mrand.Seed(time.Now().UnixNano())
-			mrand.Shuffle(len(candidates), func(i, j int) {
-				candidates[i], candidates[j] = candidates[j], candidates[i]
-			})
+	// Register before scanning: every scan candidate runs with a copy of
+	// this identity.
+	if needRegister(configFile, *renew) {
+		if err := runRegister(usquePath, configFile); err != nil {
+			logErrorAndExit(fmt.Sprintf("failed to register: %v", err))
 		}
+	}
+	cfg, err := usqueconfig.Load(configFile)
+	if err != nil {
+		logErrorAndExit(fmt.Sprintf("failed to load config: %v", err))
+	}
+	if err := cfg.Validate(); err != nil {
+		logErrorAndExit(fmt.Sprintf("invalid config %s: %v (use --renew to register again)", configFile, err))
+	}
+	if endpointKey, err = cfg.PeerKey(); err != nil {
+		logErrorAndExit(fmt.Sprintf("invalid config %s: %v (use --renew to register again)", configFile, err))
+	}
+	logInfo("successfully loaded masque identity", nil)
 
-		if len(candidates) == 0 {
-			chosen, err := pickDefaultEndpoint(*v6Flag)
+	// switchIdentity replaces an identity usque rejected, both while
+	// scanning and while supervising, and loads the new one into cfg.
+	ids := &identitySwitch{
+		pool:       pool,
+		rotate:     *identityRotate == rotateFailure,
+		usquePath:  usquePath,
+		configFile: configFile,
+		name:       idName,
+	}
+	switchIdentity := func(err error) {
+		cfg = ids.next(err)
+		configFile, idName = ids.configFile, ids.name
+	}
+
+	// A hostname endpoint expands to all of its addresses, tried in order.
+	stateEndpoint := *endpoint
+	var endpointHost, endpointPort string
+	var resolved []string
+	if !*scan {
+		host, port, err := parseEndpoint(*endpoint)
+		if err != nil {
+			logErrorAndExit(fmt.Sprintf("invalid endpoint: %v", err))
+		}
+		if net.ParseIP(host) == nil {
+			endpointHost, endpointPort = host, port
+			if sni == defaultSNI {
+				sni = host
+			}
+			resolved, err = resolveEndpoint(host, port, ipVersion(*v6Flag, *v4Flag))
 			if err != nil {
-				logErrorAndExit(err.Error())
+				logErrorAndExit(fmt.Sprintf("failed to resolve %s: %v", host, err))
 			}
-			*endpoint = chosen
+			logInfo("resolved endpoint", map[string]string{"host": host, "addresses": strings.Join(resolved, ",")})
+			resolvedEndpoints.Store(resolved)
+			*endpoint = resolved[0]
+		}
+	}
+
+	// with auto, an endpoint restored from the state keeps the transport
+	// it last worked over
+	if *transportFlag == transportAuto && fromState && prevState.Transport == transportH2 {
+		if usqueSupportsHTTP2(usquePath) {
+			transport = transportH2
+			logInfo("using saved transport", map[string]string{"transport": transport})
 		} else {
-			bindIP, bindPort := mustSplitBind(*bind)
+			logutil.Warn("saved transport is h2 but usque has no HTTP/2 transport; using QUIC", map[string]string{"usque": usquePath})
+		}
+	}
+	if transport == transportH2 && !usqueSupportsHTTP2(usquePath) {
+		logErrorAndExit(fmt.Sprintf("--transport h2: %s has no %s option; use a usque build with HTTP/2 support", usquePath, usqueHTTP2Flag))
+	}
 
-			startFn := func(ep string) (func(), bool, error) {
-				cmdCfg := make(map[string]interface{})
-				if data, err := os.ReadFile(configFile); err == nil {
-					_ = json.Unmarshal(data, &cmdCfg)
-				}
-				addEndpointToConfig(cmdCfg, ep)
-				if err := writeConfig(configFile, cmdCfg); err != nil {
-					return nil, false, err
-				}
+	// scanOnce picks an endpoint by trying candidates with usque bound on
+	// scanBind over the current transport. quicBlocked records whether it
+	// failed without any QUIC precheck getting through.
+	var quicBlocked bool
+	scanOnce := func(scanBind string) (string, error) {
+		var candidates, scanRanges []string
+		stats := scanner.LoadStats(*scanStats)
+		stats.Network = netutil.NetworkID()
+		stats.Adaptive = *scanAdaptive
+		if eps, _ := resolvedEndpoints.Load().([]string); len(eps) > 0 {
+			// addresses of a hostname endpoint keep their DNS order; the
+			// latest answer from watchHostname wins over the first one
+			logInfo("trying resolved addresses", map[string]string{"host": endpointHost})
+			candidates = append([]string(nil), eps...)
+		} else {
+			logInfo("scanner mode enabled", nil)
+			rng := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+			smp := scanner.Sampling{
+				PerCIDR:   *scanSample,
+				Stratify4: *scanStratify4,
+				Stratify6: *scanStratify6,
+			}
+			if *scanSeed != 0 {
+				rng = mrand.New(mrand.NewSource(*scanSeed))
+				smp.Rand = rng
+				logInfo("using fixed scan seed", map[string]string{"seed": strconv.FormatInt(*scanSeed, 10)})
+			}
+			list := loadEndpointLists(*endpointsFile, *endpointsURL, *endpointsCache, firstScanPort(*scanPorts))
+			candidates, scanRanges = buildCandidatesFromFlags(*v6Flag, *v4Flag, *range4, *range6, *scanPorts, *scanPortStrategy, smp, list)
+
+			listed := resolveListed(list.Filter(ipVersion(*v6Flag, *v4Flag)).Endpoints, ipVersion(*v6Flag, *v4Flag))
+			if !*scanOrdered {
+				rng.Shuffle(len(candidates), func(i, j int) {
+					candidates[i], candidates[j] = candidates[j], candidates[i]
+				})
+				rng.Shuffle(len(listed), func(i, j int) {
+					listed[i], listed[j] = listed[j], listed[i]
+				})
+			}
 
-				host, port, _ := parseEndpoint(ep)
-				localPort := 443
-				if port != "" {
-					localPort, _ = strconv.Atoi(port)
+			// stats only reorder the generated candidates
+			if *scanStats != "" && !*scanOrdered {
+				stats.Prioritize(candidates, scanRanges)
+			}
+			if *scanAdaptive && !*scanOrdered {
+				ports := splitCSV(*scanPorts)
+				if len(ports) == 0 {
+					ports = []string{defaultScanPort}
 				}
-				ip := net.ParseIP(host)
-				localIpv6 := ip != nil && ip.To4() == nil
+				explored := stats.Explore(ipVersion(*v6Flag, *v4Flag), scanRanges, 8, 4, ports, rng)
+				candidates = dedupe(append(explored, candidates...))
+				stats.Adapt(candidates, scanRanges, rng)
+				logInfo("adaptive scan ordering applied", map[string]string{"explored": strconv.Itoa(len(explored))})
+			}
+			// curated endpoints go first
+			candidates = dedupe(append(listed, candidates...))
+		}
 
-				logConfig(ep, bindIP, bindPort)
-				cmd := createUsqueCmd(usquePath, configFile, bindIP, bindPort, localPort, localIpv6)
-				stdout, _ := cmd.StdoutPipe()
-				stderr, _ := cmd.StderrPipe()
+		var netID string
+		var raced bool
+		if *dualStack && !*v4Flag && !*v6Flag {
+			netID = netutil.NetworkID()
+			candidates, raced = raceFamilies(candidates, prevState.Networks[netID], *dualStackStagger, *scanMax)
+		}
 
-				if err := cmd.Start(); err != nil {
-					return nil, false, err
+		if len(candidates) == 0 {
+			return pickDefaultEndpoint(*v6Flag)
+		} else {
+			bindIP, bindPort := mustSplitBind(scanBind)
+			var benchRows []benchRow
+			var attempts []scanner.Attempt
+
+			// with --sni-list every endpoint is probed once per SNI, and
+			// usque is started with the ones that got through
+			var probe func(string) error
+			var sniResults []scanner.SNIResult
+			sniWorks := map[string][]string{}
+			startedSNI := map[string]string{}
+			if *pingFlag {
+				probe = scanner.Prober(tunnelProbe())
+				if len(sniList) > 0 {
+					probe = func(ep string) error {
+						var lastErr error
+						for _, r := range scanner.ProbeSNIs(ep, sniList, tunnelProbe()) {
+							sniResults = append(sniResults, r)
+							if r.Err != nil {
+								lastErr = r.Err
+								continue
+							}
+							sniWorks[ep] = append(sniWorks[ep], r.SNI)
+						}
+						if len(sniWorks[ep]) > 0 {
+							return nil
+						}
+						return lastErr
+					}
 				}
+			}
 
-				st := &procState{}
-				go handleScanner(bufio.NewScanner(stdout), bindIP+":"+bindPort, st, cmd, *scanVerboseChild, *scanTunnelFailLimit)
-				go handleScanner(bufio.NewScanner(stderr), bindIP+":"+bindPort, st, cmd, *scanVerboseChild, *scanTunnelFailLimit)
-
-				deadline := time.Now().Add(*scanPerIP)
-				for time.Now().Before(deadline) {
-					st.mu.Lock()
-					ok := st.connected
-					hsFail := st.handshakeFail
-					st.mu.Unlock()
-
-					if ok {
+			startFn := func(ep string) (func(), bool, error) {
+				names := []string{sni}
+				if len(sniList) > 0 {
+					names = sniList
+					if w := sniWorks[ep]; len(w) > 0 {
+						names = w
+					}
+				}
+				var stop func()
+				var ok bool
+				var err error
+				for i, name := range names {
+					stop, ok, err = startCandidate(usquePath, cfg, configFile, bindIP, bindPort, ep, name, *scanPerIP, *scanVerboseChild, *scanTunnelFailLimit)
+					startedSNI[ep] = name
+					var rej *scanner.Rejection
+					if errors.As(err, &rej) && rej.Fatal {
+						// the account, not the SNI, was refused; switch identity now
+						return stop, false, err
+					}
+					if (err == nil && ok) || i == len(names)-1 {
 						break
 					}
-					if hsFail {
-						stop := func() { _ = cmd.Process.Kill() }
-						return stop, false, fmt.Errorf("handshake failure")
+					if stop != nil {
+						stop()
 					}
-					time.Sleep(120 * time.Millisecond)
 				}
-
-				st.mu.Lock()
-				ok := st.connected
-				st.mu.Unlock()
-
-				stop := func() { _ = cmd.Process.Kill() }
-
-				if ok {
-					wcTimeout := *scanPerIP
-					if wcTimeout <= 0 || wcTimeout > 5*time.Second {
-						wcTimeout = 5 * time.Second
-					}
-
-					bindAddr := fmt.Sprintf("%s:%s", bindIP, bindPort)
-					status, err := httpcheck.CheckWarpOverSocks(bindAddr, *testURL, wcTimeout)
-					fields := map[string]string{
-						"endpoint": ep,
-						"bind":     bindAddr,
-						"status":   string(status),
-						"url":      *testURL,
-						"timeout":  wcTimeout.String(),
+				if err != nil {
+					return stop, false, err
+				}
+				if !ok {
+					return stop, false, nil
+				}
+				wcTimeout := *scanPerIP
+				if wcTimeout <= 0 || wcTimeout > 5*time.Second {
+					wcTimeout = 5 * time.Second
+				}
+				proxyAddr := socksProxy(bindIP + ":" + bindPort)
+
+				if *scanRequire != requireConnect {
+					status, err := httpcheck.CheckWarp(proxyAddr, *testURL, wcTimeout)
+					if !requirementMet(*scanRequire, status) {
+						if err == nil {
+							err = fmt.Errorf("--scan-require %s", *scanRequire)
+						}
+						return stop, false, &scanner.Rejection{Reason: "warp_" + strings.ToLower(string(status)), Err: err}
 					}
-					if err != nil {
-						fields["error"] = err.Error()
-						logutil.Warn("warp check result", fields)
-					} else {
-						logutil.Info("warp check result", fields)
+				}
+				// explicit --check flags must pass as well
+				if len(checkSpecs) > 0 {
+					scanSuite := *checks
+					scanSuite.Timeout = wcTimeout
+					if err := scanSuite.Run(proxyAddr); err != nil {
+						return stop, false, &scanner.Rejection{Reason: "checks", Err: err}
 					}
 				}
+				if *scanBench > 0 {
+					res, err := httpcheck.Bench(proxyAddr, *benchOpts)
+					benchRows = append(benchRows, benchRow{Endpoint: ep, Result: res, Err: err})
+				}
 
-				return stop, ok, nil
+				return stop, true, nil
 			}
 
-			chosen, err := scanner.TryCandidates(
+			var det *scanner.BlockDetector
+			if *pingFlag && *scanBlockThreshold > 0 && transport == transportQUIC {
+				det = &scanner.BlockDetector{Threshold: *scanBlockThreshold, FallbackPorts: splitCSV(*scanFallbackPorts)}
+			}
+			working, err := scanner.TryCandidatesN(
 				candidates,
+				*scanBench,
 				*scanMax,
-				*pingFlag,
-				3*time.Second,
+				probe,
+				transport,
 				*scanPerIP,
 				startFn,
+				func(a scanner.Attempt) {
+					attempts = append(attempts, a)
+					stats.Record(a.Endpoint, scanRanges, a.OK)
+				},
+				det,
 			)
-			if err != nil {
-				logErrorAndExit(err.Error())
+			report := scanner.NewReport(attempts, scanRanges)
+			report.SNIs = scanner.SNIInfos(sniResults)
+			report.Print(os.Stdout)
+			if *scanReport != "" {
+				if err := report.Save(*scanReport); err != nil {
+					logutil.Warn("failed to write scan report", map[string]string{"file": *scanReport, "error": err.Error()})
+				}
+			}
+			var chosen string
+			if err == nil {
+				chosen = working[0]
+				if *scanBench > 0 {
+					printBench(benchRows)
+					if best := bestBench(benchRows); best != "" {
+						chosen = best
+						logInfo("picked fastest endpoint", map[string]string{"endpoint": best})
+					}
+				}
+			}
+			if err := stats.Save(); err != nil {
+				logutil.Warn("failed to save scan stats", map[string]string{"file": *scanStats, "error": err.Error()})
+			}
+			if chosen != "" && startedSNI[chosen] != "" {
+				sni = startedSNI[chosen]
+				if len(sniList) > 0 {
+					logInfo("selected SNI", map[string]string{"endpoint": chosen, "sni": sni})
+				}
+			}
+			if *dualStack && netID != "" {
+				recordFamily(&prevState, netID, chosen, err == nil, raced)
 			}
-			*endpoint = chosen
+			quicBlocked = err != nil && *pingFlag && transport == transportQUIC && onlyPrechecks(attempts)
+			return chosen, err
 		}
-	} else {
-		host, port, err := parseEndpoint(*endpoint)
-		if err != nil {
-			logErrorAndExit(fmt.Sprintf("invalid endpoint: %v", err))
+	}
+
+	// scanTransports runs scanOnce; with --transport auto it starts over
+	// QUIC and scans again over HTTP/2 when QUIC looks blocked.
+	scanTransports := func(scanBind string) (string, error) {
+		if *transportFlag == transportAuto {
+			transport = transportQUIC
 		}
-		ip := net.ParseIP(host)
-		if ip != nil {
-			isV6 := ip.To4() == nil
-			if useIpv6 != isV6 {
-				logInfo(fmt.Sprintf("warning: endpoint is IPv%d but --ipv6=%v; overriding to match endpoint", map[bool]int{true: 6, false: 4}[isV6], useIpv6), nil)
-				useIpv6 = isV6
-			}
-		} else if sni == defaultSNI {
-			sni = host
+		chosen, err := scanOnce(scanBind)
+		if err == nil || *transportFlag != transportAuto || !quicBlocked {
+			return chosen, err
 		}
-		if port != "" {
-			p, err := strconv.Atoi(port)
-			if err == nil {
-				connectPort = p
+		if !usqueSupportsHTTP2(usquePath) {
+			logutil.Warn("no QUIC precheck got through and usque has no HTTP/2 transport", map[string]string{"usque": usquePath})
+			return chosen, err
+		}
+		logutil.Warn("no QUIC precheck got through; scanning again over HTTP/2", map[string]string{"error": err.Error()})
+		transport = transportH2
+		return scanOnce(scanBind)
+	}
+
+	// scanFor runs scanTransports, switching identity and scanning again
+	// when usque rejects the account. It runs at startup and again after a
+	// network change.
+	scanFor := func(scanBind string) (string, error) {
+		for {
+			chosen, err := scanTransports(scanBind)
+			if !isIdentityErr(err) {
+				return chosen, err
 			}
+			switchIdentity(err)
+		}
+	}
+	if *scan || len(resolved) > 1 {
+		chosen, err := scanFor(*bind)
+		if err != nil {
+			logErrorAndExit(err.Error())
 		}
+		*endpoint = chosen
+	} else if len(sniList) > 0 {
+		sni = pickSNI(*endpoint, sniList)
+	}
+	adoptEndpoint(*endpoint)
+	configuredMTU, configuredPacketSize := mtu, initialPacketSize
+	if mtuAuto {
+		discoverMTU(*endpoint)
 	}
 
 	bindIP, bindPort := mustSplitBind(*bind)
 
-	if needRegister(configFile, *renew) {
-		if err := runRegister(usquePath); err != nil {
-			logErrorAndExit(fmt.Sprintf("failed to register: %v", err))
-		}
-	}
-	logInfo("successfully loaded masque identity", nil)
 
-	cfg := make(map[string]interface{})
-	if data, err := os.ReadFile(configFile); err == nil {
-		_ = json.Unmarshal(data, &cfg)
+	if err := addEndpointToConfig(cfg, *endpoint); err != nil {
+		logErrorAndExit(err.Error())
+	}
+	if endpointHost == "" {
+		stateEndpoint = *endpoint
 	}
 
-	addEndpointToConfig(cfg, *endpoint)
-	
 	SaveState(State{
-		Endpoint: *endpoint,
-		Socks:    fmt.Sprintf("%s:%s", bindIP, bindPort),
+		Endpoint:  stateEndpoint,
+		Socks:     fmt.Sprintf("%s:%s", bindIP, bindPort),
+		Identity:  idName,
+		SNI:       sni,
+		Transport: transport,
+		Networks:  prevState.Networks,
 	})
 
-	if err := writeConfig(configFile, cfg); err != nil {
+	if err := cfg.Save(configFile); err != nil {
 		logErrorAndExit(fmt.Sprintf("failed to write config: %v", err))
 	}
 
-	logConfig(*endpoint, bindIP, bindPort)
-	if err := runSocks(usquePath, configFile, bindIP, bindPort, *connectTimeout); err != nil {
-		logErrorAndExit(fmt.Sprintf("SOCKS start failed: %v", err))
+	var rt *router.Router
+	if *rulesFile != "" {
+		bindIP, bindPort, rt = startFrontend(*rulesFile, *geoipFile, *rulesReload, *bind, *backendBind)
+	}
+	if *pacBind != "" {
+		startPAC(*pacBind, *bind, *pacBypass, rt)
+	}
+	if *dnsBind != "" {
+		startDNS(*dnsBind, fmt.Sprintf("%s:%s", bindIP, bindPort), *dnsUpstream, *dnsRoute, *dnsCache)
+	}
+
+	restart := make(chan restartReq, 1)
+	if endpointHost != "" && *resolveInterval > 0 {
+		go watchHostname(endpointHost, endpointPort, ipVersion(*v6Flag, *v4Flag), *resolveInterval, restart)
+	}
+
+	if *netWatch {
+		go watchNetwork(*netDebounce, bindIP+":"+bindPort, checks, *scan, restart)
+	}
+	if *checkInterval > 0 {
+		go monitorHealth(*checkInterval, *checkFailures, bindIP+":"+bindPort, checks, *scan, restart)
+	}
+
+	// Once the tunnel has connected, start failures (timeouts, handshake
+	// failures) are treated as transient: retried with backoff, after a
+	// rescan when the endpoint came from one.
+	connectedOnce := false
+	retryDelay := startRetryMin
+	for {
+		activeEndpoint.Store(*endpoint)
+		logConfig(*endpoint, bindIP, bindPort, sni)
+		err := runSocks(usquePath, configFile, bindIP, bindPort, *connectTimeout, restart)
+		if err == nil {
+			return
+		}
+		var rr *restartErr
+		switch {
+		case errors.As(err, &rr):
+			connectedOnce, retryDelay = true, startRetryMin
+		case errors.Is(err, errTunnelLost):
+			connectedOnce, retryDelay = true, startRetryMin
+			logutil.Warn("tunnel lost; reconnecting", map[string]string{"error": err.Error(), "delay": reconnectDelay.String()})
+			time.Sleep(reconnectDelay)
+			continue
+		case isIdentityErr(err):
+			switchIdentity(err)
+			applyEndpoint(configFile, *endpoint)
+			SaveState(State{
+				Endpoint:  stateEndpoint,
+				Socks:     *bind,
+				Identity:  idName,
+				SNI:       sni,
+				Transport: transport,
+				Networks:  prevState.Networks,
+			})
+			continue
+		case !connectedOnce:
+			logErrorAndExit(fmt.Sprintf("SOCKS start failed: %v", err))
+		default:
+			logutil.Warn("tunnel failed to start; retrying", map[string]string{"error": err.Error(), "delay": retryDelay.String()})
+			time.Sleep(retryDelay)
+			if retryDelay *= 2; retryDelay > startRetryMax {
+				retryDelay = startRetryMax
+			}
+			rr = &restartErr{req: restartReq{Reason: "start failed: " + err.Error(), Rescan: *scan}}
+		}
+
+		logutil.Info("restarting tunnel", map[string]string{"reason": rr.req.Reason, "endpoint": rr.req.Endpoint})
+		if rr.req.Rescan {
+			if cfg, err = usqueconfig.Load(configFile); err != nil {
+				logErrorAndExit(fmt.Sprintf("failed to load config: %v", err))
+			}
+			if mtuAuto {
+				// prechecks use the configured sizes until the new path is measured
+				mtu, initialPacketSize = configuredMTU, configuredPacketSize
+			}
+			chosen, err := scanFor(bindIP + ":" + bindPort)
+			if err != nil {
+				logutil.Warn("rescan failed; reconnecting to the previous endpoint", map[string]string{"error": err.Error()})
+			} else {
+				rr.req.Endpoint = chosen
+			}
+		}
+		if rr.req.Endpoint != "" && rr.req.Endpoint != *endpoint {
+			*endpoint = rr.req.Endpoint
+			adoptEndpoint(*endpoint)
+			applyEndpoint(configFile, *endpoint)
+			if endpointHost == "" {
+				stateEndpoint = *endpoint
+				SaveState(State{
+					Endpoint:  stateEndpoint,
+					Socks:     *bind,
+					Identity:  idName,
+					SNI:       sni,
+					Transport: transport,
+					Networks:  prevState.Networks,
+				})
+			}
+		}
+		if mtuAuto && (rr.req.Rescan || rr.req.Endpoint != "" || rr.req.Network) {
+			discoverMTU(*endpoint)
+		}
 	}
 }
 
 // ------------------------ Helpers ------------------------
 
-func buildCandidatesFromFlags(v6, v4 bool, r4csv, r6csv string) []string {
-	ports := []string{
-		"443",
-		//"500",
-		//"1701",
-		//"4500",
-		//"4443",
-		//"8443",
-		//"8095",
+// buildCandidatesFromFlags expands the scan ranges into endpoints. It also
+// returns the ranges used, so results can be attributed back to them.
+// When an endpoints list is given, its CIDRs replace the default ranges
+// (explicit --range4/--range6 still apply); its plain endpoints are not
+// included here.
+func buildCandidatesFromFlags(v6, v4 bool, r4csv, r6csv, portsCSV, portStrategy string, smp scanner.Sampling, list scanner.EndpointList) ([]string, []string) {
+	ports := []string{defaultScanPort}
+	if strings.TrimSpace(portsCSV) != "" {
+		ports = splitCSV(portsCSV)
+		for _, p := range ports {
+			if err := validatePort(p); err != nil {
+				logErrorAndExit(fmt.Sprintf("--scan-ports: %v", err))
+			}
+		}
+	}
+	switch portStrategy {
+	case scanner.PortRandom, scanner.PortCross:
+	default:
+		logErrorAndExit(fmt.Sprintf("invalid --scan-port-strategy %q (want random or cross)", portStrategy))
 	}
 
 	var r4, r6 []string
 	if strings.TrimSpace(r4csv) != "" {
 		r4 = splitCSV(r4csv)
-	} else {
+	} else if list.Empty() {
 		r4 = append([]string{}, defaultRange4...)
 	}
 	if strings.TrimSpace(r6csv) != "" {
 		r6 = splitCSV(r6csv)
-	} else {
+	} else if list.Empty() {
 		r6 = append([]string{}, defaultRange6...)
 	}
+	r4 = append(r4, list.CIDRs4...)
+	r6 = append(r6, list.CIDRs6...)
+
+	ver := ipVersion(v6, v4)
 
-	ver := scanner.Any
+	ranges := append(append([]string{}, r4...), r6...)
+	cands, err := scanner.BuildCandidates(ver, r4, r6, ports, portStrategy, smp)
+	if err != nil {
+		logInfo(fmt.Sprintf("scanner.BuildCandidates error: %v", err), nil)
+		return nil, ranges
+	}
+	return cands, ranges
+}
+
+func ipVersion(v6, v4 bool) int {
 	if v6 {
-		ver = scanner.V6
+		return scanner.V6
 	} else if v4 {
-		ver = scanner.V4
+		return scanner.V4
+	}
+	return scanner.Any
+}
+
+func firstScanPort(portsCSV string) string {
+	if ports := splitCSV(portsCSV); len(ports) > 0 {
+		return ports[0]
 	}
+	return defaultScanPort
+}
 
-	cands, err := scanner.BuildCandidates(ver, r4, r6, ports)
-	if err != nil {
-		logInfo(fmt.Sprintf("scanner.BuildCandidates error: %v", err), nil)
-		return nil
+// tunnelProbe returns precheck options matching the usque tunnel on the
+// current transport, pinned to the identity's endpoint key.
+func tunnelProbe() scanner.ProbeOptions {
+	o := scanner.TunnelProbe(sni, initialPacketSize, keepalivePeriod, 3*time.Second)
+	o.PeerKey = endpointKey
+	if transport == transportH2 {
+		o.TCP = true
+		o.ALPN = []string{"h2"}
+	}
+	return o
+}
+
+// raceFamilies runs a happy-eyeballs race between the IPv4 and IPv6
+// candidates and reorders them: the winner first, then the rest of its
+// family, then the other family. The family with the better record on this
+// network gets the head start. raced is false when there was nothing to
+// race (only one family present).
+func raceFamilies(candidates []string, pref *FamilyStats, stagger time.Duration, scanMax int) (out []string, raced bool) {
+	v4, v6, other := scanner.SplitFamilies(candidates)
+	if len(v4) == 0 || len(v6) == 0 {
+		return candidates, false
+	}
+	first, second := v4, v6
+	if pref.PreferV6() {
+		first, second = v6, v4
+	}
+	perFamily := scanMax
+	if perFamily <= 0 || perFamily > 8 {
+		perFamily = 8
+	}
+	logInfo("racing IPv4 and IPv6 candidates", map[string]string{
+		"first":   map[bool]string{true: "ipv6", false: "ipv4"}[pref.PreferV6()],
+		"stagger": stagger.String(),
+	})
+
+	winner, ok := scanner.RaceFamilies(first, second, stagger, scanner.Prober(tunnelProbe()), perFamily)
+	if !ok {
+		logutil.Warn("no candidate answered the dual-stack race; keeping scan order", nil)
+		return candidates, true
+	}
+	fam, rest := v4, v6
+	if _, w6, _ := scanner.SplitFamilies([]string{winner}); len(w6) > 0 {
+		fam, rest = v6, v4
+	}
+	out = append(out, winner)
+	for _, ep := range fam {
+		if ep != winner {
+			out = append(out, ep)
+		}
+	}
+	out = append(out, rest...)
+	return append(out, other...), true
+}
+
+// recordFamily updates the per-network family stats in st after a scan. A
+// scan that raced both families and found nothing counts against both.
+func recordFamily(st *State, netID, chosen string, ok, raced bool) {
+	if st.Networks == nil {
+		st.Networks = map[string]*FamilyStats{}
+	}
+	f := st.Networks[netID]
+	if f == nil {
+		f = &FamilyStats{}
+		st.Networks[netID] = f
+	}
+	if !ok {
+		if raced {
+			f.Record(false, false)
+			f.Record(true, false)
+		}
+		return
+	}
+	host, _, _ := parseEndpoint(chosen)
+	if ip := net.ParseIP(host); ip != nil {
+		f.Record(ip.To4() == nil, true)
 	}
-	return cands
+}
+
+// loadEndpointLists reads --endpoints-file and --endpoints-url (either may be empty).
+func loadEndpointLists(file, url, cache, defaultPort string) scanner.EndpointList {
+	var list scanner.EndpointList
+	if file != "" {
+		l, err := scanner.LoadEndpointFile(file, defaultPort)
+		if err != nil {
+			logErrorAndExit(fmt.Sprintf("failed to load endpoints file: %v", err))
+		}
+		list.Merge(l)
+	}
+	if url != "" {
+		l, err := scanner.FetchEndpointList(url, cache, defaultPort, 15*time.Second)
+		if err != nil {
+			logErrorAndExit(fmt.Sprintf("failed to load endpoints url: %v", err))
+		}
+		list.Merge(l)
+	}
+	if (file != "" || url != "") && list.Empty() {
+		logErrorAndExit("endpoints list is empty")
+	}
+	return list
 }
 
 func splitCSV(s string) []string {
@@ -384,16 +923,11 @@ func validatePort(p string) error {
 	return nil
 }
 
-func writeConfig(path string, cfg map[string]interface{}) error {
-	data, _ := json.MarshalIndent(cfg, "", "  ")
-	return os.WriteFile(path, data, 0644)
-}
-
-func logConfig(endpoint, bindIP, bindPort string) {
+func logConfig(endpoint, bindIP, bindPort, serverName string) {
 	fields := map[string]string{
 		"endpoint":     endpoint,
 		"bind":         fmt.Sprintf("%s:%s", bindIP, bindPort),
-		"sni":          sni,
+		"sni":          serverName,
 		"connect-port": strconv.Itoa(connectPort),
 		"ipv6":         strconv.FormatBool(useIpv6),
 		"dns":          dnsStr,
@@ -408,6 +942,129 @@ func logConfig(endpoint, bindIP, bindPort string) {
 	logInfo("starting usque with configuration", fields)
 }
 
+// startFrontend starts the split-tunnel front-end on bind and returns the
+// backend address usque should listen on instead.
+func startFrontend(rulesFile, geoipFile string, reload time.Duration, bind, backendBind string) (string, string, *router.Router) {
+	rt, err := router.New(rulesFile, geoipFile)
+	if err != nil {
+		logErrorAndExit(fmt.Sprintf("failed to load rules: %v", err))
+	}
+
+	if backendBind == "" {
+		port, err := freeLocalPort()
+		if err != nil {
+			logErrorAndExit(fmt.Sprintf("failed to pick backend port: %v", err))
+		}
+		backendBind = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	backendIP, backendPort := mustSplitBind(backendBind)
+	if backendBind == bind {
+		logErrorAndExit("--backend-bind must differ from --bind")
+	}
+
+	srv := &frontend.Server{
+		Listen:   bind,
+		Backend:  backendBind,
+		Username: username,
+		Password: password,
+		Router:   rt,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			logErrorAndExit(fmt.Sprintf("front-end failed: %v", err))
+		}
+	}()
+	go rt.Watch(reload, nil)
+
+	logInfo("split tunneling enabled", map[string]string{
+		"rules":   rulesFile,
+		"rules-n": strconv.Itoa(len(rt.Rules().Rules)),
+		"final":   string(rt.Rules().Final),
+		"backend": backendBind,
+	})
+	return backendIP, backendPort, rt
+}
+
+// startPAC serves a PAC file pointing browsers at the SOCKS bind. rt may be
+// nil when split tunneling is disabled.
+func startPAC(pacBind, socksBind, bypassCSV string, rt *router.Router) {
+	mustSplitBind(pacBind)
+	bypass, err := pac.ParseBypass(splitCSV(bypassCSV))
+	if err != nil {
+		logErrorAndExit(err.Error())
+	}
+	srv := &pac.Server{
+		Listen: pacBind,
+		Proxy:  socksBind,
+		Bypass: bypass,
+		Router: rt,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			logErrorAndExit(fmt.Sprintf("PAC server failed: %v", err))
+		}
+	}()
+}
+
+// startDNS runs the local DNS server, forwarding through the usque SOCKS
+// backend at socksAddr.
+func startDNS(dnsBind, socksAddr, upstreamCSV, routeCSV string, cacheSize int) {
+	mustSplitBind(dnsBind)
+
+	var auth *proxy.Auth
+	if username != "" && password != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", socksAddr, auth, proxy.Direct)
+	if err != nil {
+		logErrorAndExit(fmt.Sprintf("dns: socks dialer: %v", err))
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		logErrorAndExit("dns: socks dialer does not support contexts")
+	}
+
+	var ups []dnsserver.Upstream
+	for _, u := range splitCSV(upstreamCSV) {
+		up, err := dnsserver.ParseUpstream(u, cd)
+		if err != nil {
+			logErrorAndExit(err.Error())
+		}
+		ups = append(ups, up)
+	}
+	if len(ups) == 0 {
+		logErrorAndExit("--dns-upstream must list at least one upstream")
+	}
+	routes, err := dnsserver.ParseRoutes(splitCSV(routeCSV), cd)
+	if err != nil {
+		logErrorAndExit(err.Error())
+	}
+
+	srv := &dnsserver.Server{
+		Listen:    dnsBind,
+		Upstreams: ups,
+		Routes:    routes,
+		Timeout:   dnsTimeout,
+	}
+	if cacheSize > 0 {
+		srv.Cache = dnsserver.NewCache(cacheSize)
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			logErrorAndExit(fmt.Sprintf("DNS server failed: %v", err))
+		}
+	}()
+}
+
+func freeLocalPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
 // ------------------------ Endpoint ------------------------
 
 func parseEndpoint(ep string) (host, port string, err error) {
@@ -443,14 +1100,14 @@ func parseEndpoint(ep string) (host, port string, err error) {
 	return host, port, nil
 }
 
-func addEndpointToConfig(cfg map[string]interface{}, endpoint string) {
+func addEndpointToConfig(cfg *usqueconfig.Config, endpoint string) error {
 	if endpoint == "" {
-		return
+		return nil
 	}
 
 	host, port, err := parseEndpoint(endpoint)
 	if err != nil {
-		logErrorAndExit(fmt.Sprintf("invalid endpoint: %v", err))
+		return fmt.Errorf("invalid endpoint: %v", err)
 	}
 
 	if port == "" {
@@ -459,61 +1116,178 @@ func addEndpointToConfig(cfg map[string]interface{}, endpoint string) {
 
 	ip := net.ParseIP(host)
 	if ip != nil {
+		cfg.SetEndpoint(ip, port)
 		if ip.To4() != nil {
-			cfg["endpoint_v4"] = host
-			cfg["endpoint_v4_port"] = port
 			logInfo("using IPv4 endpoint", nil)
 		} else {
-			cfg["endpoint_v6"] = host
-			cfg["endpoint_v6_port"] = port
 			logInfo("using IPv6 endpoint", nil)
 		}
-		return
+		return nil
 	}
 
-	ips, err := net.LookupIP(host)
+	// Hostnames from endpoint lists: take the first address, preferred
+	// family first.
+	eps, err := resolveEndpoint(host, port, scanner.Any)
 	if err != nil {
-		logErrorAndExit(fmt.Sprintf("failed to resolve %s: %v", host, err))
-	}
-	if len(ips) == 0 {
-		logErrorAndExit(fmt.Sprintf("no IPs for %s", host))
+		return fmt.Errorf("failed to resolve %s: %v", host, err)
 	}
+	h, _, _ := net.SplitHostPort(eps[0])
+	chosen := net.ParseIP(h)
+	isV6 := chosen.To4() == nil
+	cfg.SetEndpoint(chosen, port)
+	logInfo(fmt.Sprintf("using resolved IPv%s endpoint for %s", map[bool]string{true: "6", false: "4"}[isV6], host), nil)
+	return nil
+}
 
-	var chosen net.IP
-	hasV4, hasV6 := false, false
-	for _, i := range ips {
-		if i.To4() != nil {
-			hasV4 = true
-		} else {
-			hasV6 = true
+// adoptEndpoint aligns --ipv6 and --connect-port with the endpoint about to
+// be used.
+func adoptEndpoint(endpoint string) {
+	host, port, err := parseEndpoint(endpoint)
+	if err != nil {
+		logErrorAndExit(fmt.Sprintf("invalid endpoint: %v", err))
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		isV6 := ip.To4() == nil
+		if useIpv6 != isV6 {
+			logInfo(fmt.Sprintf("warning: endpoint is IPv%d but --ipv6=%v; overriding to match endpoint", map[bool]int{true: 6, false: 4}[isV6], useIpv6), nil)
+			useIpv6 = isV6
 		}
 	}
+	if port != "" {
+		if p, err := strconv.Atoi(port); err == nil {
+			connectPort = p
+		}
+	}
+}
+
+// startCandidate runs usque against ep with SNI serverName and a throwaway
+// copy of base bound on bindIP:bindPort, and waits up to timeout for the
+// tunnel to come up.
+// The caller must call the returned stop function (when non-nil).
+func startCandidate(usquePath string, base *usqueconfig.Config, configFile, bindIP, bindPort, ep, serverName string, timeout time.Duration, verbose bool, failLimit int) (func(), bool, error) {
+	if failLimit <= 0 {
+		failLimit = 1
+	}
+	scanCfg, err := writeScanConfig(base, ep)
+	if err != nil {
+		return nil, false, err
+	}
+	cleanup := func() { _ = os.Remove(scanCfg) }
 
-	preferV6 := useIpv6
-	if preferV6 && !hasV6 {
-		preferV6 = false
-	} else if !preferV6 && !hasV4 {
-		preferV6 = true
+	host, port, _ := parseEndpoint(ep)
+	localPort := 443
+	if port != "" {
+		localPort, _ = strconv.Atoi(port)
 	}
+	ip := net.ParseIP(host)
+	localIpv6 := ip != nil && ip.To4() == nil
+
+	logConfig(ep, bindIP, bindPort, serverName)
+	cmd := createUsqueCmd(usquePath, scanCfg, bindIP, bindPort, serverName, localPort, localIpv6)
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return nil, false, err
+	}
+	stop := func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		cleanup()
+	}
+
+	st := &procState{}
+	go handleScanner(bufio.NewScanner(stdout), bindIP+":"+bindPort, st, cmd, verbose, failLimit)
+	go handleScanner(bufio.NewScanner(stderr), bindIP+":"+bindPort, st, cmd, verbose, failLimit)
 
-	for _, i := range ips {
-		if (preferV6 && i.To4() == nil) || (!preferV6 && i.To4() != nil) {
-			chosen = i
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		st.mu.Lock()
+		ok := st.connected
+		hsFail := st.handshakeFail
+		tunnelFail := st.tunnelFailCnt >= failLimit
+		idErr := st.identityErr()
+		st.mu.Unlock()
+
+		if ok {
 			break
 		}
+		if idErr != nil {
+			return stop, false, &scanner.Rejection{Reason: scanner.ReasonIdentity, Err: idErr, Fatal: true}
+		}
+		if hsFail {
+			return stop, false, &scanner.Rejection{Reason: scanner.ReasonHandshake}
+		}
+		if tunnelFail {
+			return stop, false, &scanner.Rejection{Reason: scanner.ReasonTunnel, Err: fmt.Errorf("failed to connect tunnel %d times", failLimit)}
+		}
+		time.Sleep(120 * time.Millisecond)
 	}
-	if chosen == nil {
-		chosen = ips[0]
+
+	st.mu.Lock()
+	ok := st.connected
+	st.mu.Unlock()
+	return stop, ok, nil
+}
+
+// writeScanConfig writes a throwaway copy of base pointing at ep to the
+// system temp directory, so scanning never touches the canonical config
+// and a crash leaves nothing next to it. The caller removes the returned
+// file when the candidate is done.
+func writeScanConfig(base *usqueconfig.Config, ep string) (string, error) {
+	f, err := os.CreateTemp("", "masque-plus-scan-*.json")
+	if err != nil {
+		return "", err
 	}
+	path := f.Name()
+	f.Close()
 
-	isV6 := chosen.To4() == nil
-	version := "v4"
-	if isV6 {
-		version = "v6"
+	c := *base
+	if err := addEndpointToConfig(&c, ep); err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+	if err := c.Save(path); err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// applyEndpoint writes endpoint into an existing config file.
+func applyEndpoint(configFile, endpoint string) {
+	cfg, err := usqueconfig.Load(configFile)
+	if err != nil {
+		logErrorAndExit(fmt.Sprintf("failed to load config: %v", err))
+	}
+	if err := cfg.Validate(); err != nil {
+		logErrorAndExit(fmt.Sprintf("invalid config %s: %v", configFile, err))
+	}
+	if err := addEndpointToConfig(cfg, endpoint); err != nil {
+		logErrorAndExit(err.Error())
+	}
+	if err := cfg.Save(configFile); err != nil {
+		logErrorAndExit(fmt.Sprintf("failed to write config: %v", err))
 	}
-	cfg["endpoint_"+version] = chosen.String()
-	cfg["endpoint_"+version+"_port"] = port
-	logInfo(fmt.Sprintf("using resolved IPv%s endpoint for %s", map[bool]string{true: "6", false: "4"}[isV6], host), nil)
+}
+
+// reRegister moves the rejected config aside to configFile+".bak" and
+// registers a fresh identity in its place. On failure the backup is restored.
+func reRegister(usquePath, configFile string) error {
+	backup := configFile + ".bak"
+	if err := os.Rename(configFile, backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("backup config: %w", err)
+	}
+	logInfo("old config backed up", map[string]string{"backup": backup})
+
+	if err := runRegister(usquePath, configFile); err != nil {
+		if rerr := os.Rename(backup, configFile); rerr != nil {
+			logutil.Warn("failed to restore config backup", map[string]string{"backup": backup, "error": rerr.Error()})
+		}
+		return err
+	}
+	return nil
 }
 
 func needRegister(configFile string, renew bool) bool {
@@ -528,14 +1302,40 @@ func needRegister(configFile string, renew bool) bool {
 
 // ------------------------ Process & Scanner ------------------------
 
+var (
+	errPrivateKey  = errors.New("failed to get private key")
+	errLoginFailed = errors.New("login failed")
+	errTunnelLost  = errors.New("tunnel lost")
+)
+
+// isIdentityErr reports whether err means the account itself was rejected,
+// as opposed to an endpoint or network problem.
+func isIdentityErr(err error) bool {
+	return errors.Is(err, errPrivateKey) || errors.Is(err, errLoginFailed)
+}
+
 type procState struct {
 	mu             sync.Mutex
 	connected      bool
 	privateKeyErr  bool
+	loginFail      bool
 	endpointErr    bool
 	handshakeFail  bool
 	serveAddrShown bool
 	tunnelFailCnt  int
+	frameTooLarge  chan struct{} // signalled when usque drops an oversized datagram
+}
+
+// identityErr returns errPrivateKey or errLoginFailed when usque rejected
+// the account, nil otherwise. Callers hold st.mu.
+func (st *procState) identityErr() error {
+	switch {
+	case st.privateKeyErr:
+		return errPrivateKey
+	case st.loginFail:
+		return errLoginFailed
+	}
+	return nil
 }
 
 func (st *procState) markConnected() {
@@ -544,78 +1344,36 @@ func (st *procState) markConnected() {
 	st.connected = true
 }
 
-func runRegister(path string) error {
-    errorKeywords := []string{
-        "registering with locale",
-        "you already have a config",
-        "you must accept the terms of service",
-        "enrolling device key",
-        "successful registration",
-        "config saved",
-        "only use the register command",
-        "failed to open config file",
-    }
-
-    cmd := exec.Command(path, "register", "-n", "masque-plus")
-    stdin, _ := cmd.StdinPipe()
-    stdout, _ := cmd.StdoutPipe()
-    stderr, _ := cmd.StderrPipe()
-
-    if err := cmd.Start(); err != nil {
-        return err
-    }
-
-    go func() {
-        scan := bufio.NewScanner(stdout)
-        for scan.Scan() {
-            line := scan.Text()
-            skip := false
-            for _, kw := range errorKeywords {
-                if strings.Contains(strings.ToLower(line), kw) {
-                    skip = true
-                    break
-                }
-            }
-            if !skip {
-                fmt.Println(line)
-            }
-        }
-    }()
-
-    go func() {
-        scan := bufio.NewScanner(stderr)
-        for scan.Scan() {
-            line := scan.Text()
-            skip := false
-            for _, kw := range errorKeywords {
-                if strings.Contains(strings.ToLower(line), kw) {
-                    skip = true
-                    break
-                }
-            }
-            if !skip {
-                fmt.Fprintln(os.Stderr, line)
-            }
-        }
-    }()
-
-    go func() {
-        time.Sleep(100 * time.Millisecond)
-        stdin.Write([]byte("y\n"))
-        time.Sleep(100 * time.Millisecond)
-        stdin.Write([]byte("y\n"))
-        stdin.Close()
-    }()
-
-    return cmd.Wait()
-}
-
-func createUsqueCmd(usquePath, config, bindIP, bindPort string, masquePort int, useV6 bool) *exec.Cmd {
-	args := []string{"socks", "--config", config, "-b", bindIP, "-p", bindPort, "-P", strconv.Itoa(masquePort), "-s", sni}
+func runRegister(path, configFile string) error {
+	if registerNative {
+		return register.RunNative(register.NativeOptions{
+			BaseURL:    registerAPI,
+			ConfigFile: configFile,
+			DeviceName: "masque-plus",
+			AcceptTOS:  acceptTOS,
+			Timeout:    registerTimeout,
+			Retries:    registerRetries,
+		})
+	}
+	return register.Run(register.Options{
+		UsquePath:  path,
+		ConfigFile: configFile,
+		DeviceName: "masque-plus",
+		AcceptTOS:  acceptTOS,
+		Timeout:    registerTimeout,
+		Retries:    registerRetries,
+	})
+}
+
+func createUsqueCmd(usquePath, config, bindIP, bindPort, serverName string, masquePort int, useV6 bool) *exec.Cmd {
+	args := []string{"socks", "--config", config, "-b", bindIP, "-p", bindPort, "-P", strconv.Itoa(masquePort), "-s", serverName}
 
 	if useV6 {
 		args = append(args, "-6")
 	}
+	if transport == transportH2 {
+		args = append(args, usqueHTTP2Flag)
+	}
 	if dnsStr != "" {
 		for _, d := range splitCSV(dnsStr) {
 			if ip := net.ParseIP(d); ip == nil {
@@ -648,8 +1406,141 @@ func createUsqueCmd(usquePath, config, bindIP, bindPort string, masquePort int,
 	return exec.Command(usquePath, args...)
 }
 
-func runSocks(path, config, bindIP, bindPort string, connectTimeout time.Duration) error {
-	cmd := createUsqueCmd(path, config, bindIP, bindPort, connectPort, useIpv6)
+// restartReq asks the supervisor to replace the running usque child.
+// Endpoint, when set, is the endpoint to use from then on.
+type restartReq struct {
+	Reason   string
+	Endpoint string
+	Rescan   bool  // pick a new endpoint by scanning first
+	Gen      int64 // tunnelGen the request is about; a later tunnel ignores it
+	Network  bool  // the local network changed, so the path may have too
+}
+
+// tunnelGen counts tunnel connections and activeEndpoint is the endpoint
+// the supervisor runs usque against. Watchers tag their restart requests
+// with the generation they checked, so a request about a tunnel that has
+// since been replaced does not kill the new one.
+var (
+	tunnelGen      atomic.Int64
+	activeEndpoint atomic.Value // string
+)
+
+// restartErr is returned by runSocks when the child was stopped on request.
+type restartErr struct{ req restartReq }
+
+func (e *restartErr) Error() string { return "restart requested: " + e.req.Reason }
+
+// requestRestart queues r unless a restart is already pending.
+func requestRestart(ch chan<- restartReq, r restartReq) {
+	select {
+	case ch <- r:
+	default:
+	}
+}
+
+// watchNetwork checks the tunnel through socksAddr after every (debounced)
+// local network change and, if it no longer works, asks the supervisor to
+// reconnect, or to rescan when the endpoint came from a scan.
+func watchNetwork(debounce time.Duration, socksAddr string, checks *httpcheck.Suite, rescan bool, restart chan<- restartReq) {
+	for range netwatch.Watch(debounce, nil) {
+		logutil.Info("network change detected; checking tunnel", map[string]string{"bind": socksAddr})
+		gen := tunnelGen.Load()
+		err := checks.Run(socksProxy(socksAddr))
+		if err == nil {
+			continue
+		}
+		requestRestart(restart, restartReq{Reason: "network changed: " + err.Error(), Rescan: rescan, Gen: gen, Network: true})
+	}
+}
+
+// monitorHealth runs the checks every interval and asks for a reconnect
+// (or rescan) after failures consecutive failed rounds.
+func monitorHealth(interval time.Duration, failures int, socksAddr string, checks *httpcheck.Suite, rescan bool, restart chan<- restartReq) {
+	if failures <= 0 {
+		failures = 1
+	}
+	failed := 0
+	var lastGen int64
+	for range time.Tick(interval) {
+		gen := tunnelGen.Load()
+		if gen != lastGen {
+			// failures of a replaced tunnel don't count against this one
+			failed, lastGen = 0, gen
+		}
+		err := checks.Run(socksProxy(socksAddr))
+		if err == nil {
+			failed = 0
+			continue
+		}
+		if failed++; failed < failures {
+			continue
+		}
+		failed = 0
+		requestRestart(restart, restartReq{Reason: "health check failed: " + err.Error(), Rescan: rescan, Gen: gen})
+	}
+}
+
+// Acceptance levels for --scan-require.
+const (
+	requireWarp    = "warp"
+	requireHTTP    = "http"
+	requireConnect = "connect"
+)
+
+// requirementMet reports whether a warp check status satisfies level.
+func requirementMet(level string, status httpcheck.ResultStatus) bool {
+	switch level {
+	case requireConnect:
+		return true
+	case requireHTTP:
+		return status == httpcheck.StatusOK || status == httpcheck.StatusNoWarp
+	}
+	return status == httpcheck.StatusOK
+}
+
+// socksProxy describes the local SOCKS bind for connectivity checks.
+func socksProxy(addr string) httpcheck.Proxy {
+	return httpcheck.Proxy{Addr: addr, Username: username, Password: password}
+}
+
+// buildChecks parses --check specs; without any, the warp trace check on
+// testURL is used.
+func buildChecks(specs []string, mode, testURL string) *httpcheck.Suite {
+	s := &httpcheck.Suite{}
+	switch mode {
+	case "all":
+	case "any":
+		s.Any = true
+	default:
+		logErrorAndExit(fmt.Sprintf("invalid --check-mode %q (want all or any)", mode))
+	}
+	for _, spec := range specs {
+		c, err := httpcheck.ParseCheck(spec)
+		if err != nil {
+			logErrorAndExit(err.Error())
+		}
+		s.Checks = append(s.Checks, c)
+	}
+	if len(s.Checks) == 0 {
+		s.Checks = []httpcheck.Checker{httpcheck.WarpCheck(testURL)}
+	}
+	return s
+}
+
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ", ") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runSocks starts usque and supervises it. Once connected it keeps running
+// until the child exits or a restart is requested on restart.
+func runSocks(path, config, bindIP, bindPort string, connectTimeout time.Duration, restart <-chan restartReq) error {
+	cmd := createUsqueCmd(path, config, bindIP, bindPort, sni, connectPort, useIpv6)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -664,7 +1555,8 @@ func runSocks(path, config, bindIP, bindPort string, connectTimeout time.Duratio
 		return err
 	}
 
-	state := &procState{}
+	state := &procState{frameTooLarge: make(chan struct{}, 1)}
+	frameWarned := false
 	go handleScanner(bufio.NewScanner(stdout), bindIP+":"+bindPort, state, cmd, true, 3)
 	go handleScanner(bufio.NewScanner(stderr), bindIP+":"+bindPort, state, cmd, true, 3)
 
@@ -672,17 +1564,22 @@ func runSocks(path, config, bindIP, bindPort string, connectTimeout time.Duratio
 	go func() { waitCh <- cmd.Wait() }()
 
 	start := time.Now()
+	var gen int64
 
 	for {
 		select {
 		case err := <-waitCh:
-			if state.privateKeyErr {
-				return fmt.Errorf("failed to get private key")
+			state.mu.Lock()
+			idErr := state.identityErr()
+			endpointErr, handshakeFail := state.endpointErr, state.handshakeFail
+			state.mu.Unlock()
+			if idErr != nil {
+				return idErr
 			}
-			if state.endpointErr {
+			if endpointErr {
 				return fmt.Errorf("failed to set endpoint")
 			}
-			if state.handshakeFail {
+			if handshakeFail {
 				return fmt.Errorf("handshake failure")
 			}
 			return err
@@ -693,7 +1590,39 @@ func runSocks(path, config, bindIP, bindPort string, connectTimeout time.Duratio
 			state.mu.Unlock()
 
 			if connected {
-				select {}
+				if gen == 0 {
+					gen = tunnelGen.Add(1)
+				}
+				select {
+				case err := <-waitCh:
+					if err == nil {
+						err = errors.New("usque exited")
+					}
+					return fmt.Errorf("%w: %v", errTunnelLost, err)
+				case r := <-restart:
+					if r.Gen != 0 && r.Gen != gen {
+						logutil.Info("ignoring restart request for a replaced tunnel", map[string]string{"reason": r.Reason})
+						continue
+					}
+					_ = cmd.Process.Kill()
+					<-waitCh
+					return &restartErr{req: r}
+				case <-state.frameTooLarge:
+					if !mtuAuto || !shrinkTunnel() {
+						if !frameWarned {
+							logutil.Warn("usque dropped a datagram too large for the path", map[string]string{
+								"mtu":                 strconv.Itoa(mtu),
+								"initial_packet_size": strconv.Itoa(initialPacketSize),
+								"mtu_auto":            strconv.FormatBool(mtuAuto),
+							})
+							frameWarned = true
+						}
+						continue
+					}
+					_ = cmd.Process.Kill()
+					<-waitCh
+					return &restartErr{req: restartReq{Reason: fmt.Sprintf("datagram frame too large; mtu %d, initial packet size %d", mtu, initialPacketSize)}}
+				}
 			}
 
 			if time.Since(start) > connectTimeout {
@@ -722,6 +1651,13 @@ func handleScanner(scan *bufio.Scanner, bind string, st *procState, cmd *exec.Cm
 		line := scan.Text()
 		lower := strings.ToLower(line)
 
+		if st.frameTooLarge != nil && strings.Contains(lower, "datagram frame too large") {
+			select {
+			case st.frameTooLarge <- struct{}{}:
+			default:
+			}
+		}
+
 		skip := false
 		for _, kw := range skipKeywords {
 			if strings.Contains(lower, kw) {
@@ -760,6 +1696,7 @@ func handleScanner(scan *bufio.Scanner, bind string, st *procState, cmd *exec.Cm
 			_ = cmd.Process.Kill()
 
 		case strings.Contains(lower, "login failed!"):
+			st.loginFail = true
 			_ = cmd.Process.Kill()
 
 		case strings.Contains(lower, "failed to connect tunnel"):
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+
+	"masque-plus/internal/logutil"
+	"masque-plus/internal/scanner"
+)
+
+// Tunnel sizing for --mtu-auto. tunnelOverhead is what MASQUE wraps
+// around an inner IP packet: a QUIC short header (up to 20 byte
+// connection ID, 4 byte packet number), the AEAD tag, the DATAGRAM frame
+// type and the HTTP datagram IDs. minTunnelMTU is the IPv6 minimum link
+// MTU; the tunnel never goes below it.
+const (
+	tunnelOverhead = 48
+	mtuStep        = 40
+	minTunnelMTU   = 1280
+)
+
+var mtuAuto bool
+
+// discoverMTU measures the largest QUIC packet size that reaches ep and
+// sizes the tunnel to it: the initial packet size becomes that size and
+// the MTU whatever fits inside. On failure the configured sizes stay.
+func discoverMTU(ep string) {
+	if transport != transportQUIC {
+		return
+	}
+	size, err := scanner.DiscoverPacketSize(ep, tunnelProbe(), 2)
+	if err != nil {
+		logutil.Warn("MTU discovery failed; keeping configured sizes", map[string]string{"endpoint": ep, "error": err.Error()})
+		return
+	}
+	initialPacketSize = size
+	mtu = size - tunnelOverhead
+	if mtu < minTunnelMTU {
+		logutil.Warn("path is too small for a full tunnel MTU; using the minimum", map[string]string{"packet_size": strconv.Itoa(size), "mtu": strconv.Itoa(minTunnelMTU)})
+		mtu = minTunnelMTU
+	}
+	logInfo("path MTU discovered", map[string]string{
+		"endpoint":    ep,
+		"packet_size": strconv.Itoa(size),
+		"mtu":         strconv.Itoa(mtu),
+	})
+}
+
+// shrinkTunnel reacts to usque reporting a datagram too large for the
+// path: it lowers the MTU by mtuStep, or once the MTU is at minTunnelMTU
+// the initial packet size, down to the smallest one QUIC allows. It
+// reports false when both are already at their minimum.
+func shrinkTunnel() bool {
+	switch {
+	case mtu > minTunnelMTU:
+		if mtu -= mtuStep; mtu < minTunnelMTU {
+			mtu = minTunnelMTU
+		}
+	case initialPacketSize > scanner.MinPacketSize:
+		if initialPacketSize -= mtuStep; initialPacketSize < scanner.MinPacketSize {
+			initialPacketSize = scanner.MinPacketSize
+		}
+	default:
+		return false
+	}
+	return true
+}
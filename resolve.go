@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"masque-plus/internal/dnsserver"
+	"masque-plus/internal/logutil"
+	"masque-plus/internal/scanner"
+
+	"golang.org/x/net/proxy"
+)
+
+// resolver resolves endpoint hostnames; it never goes through the tunnel.
+var resolver = &dnsserver.Resolver{Retries: 3}
+
+// resolvedEndpoints holds the current addresses ([]string) of a hostname
+// endpoint: watchHostname replaces them and rescans try them.
+var resolvedEndpoints atomic.Value
+
+// setupResolver selects the bootstrap resolver: the system one when raw is
+// empty, otherwise a dnsserver upstream URL dialed directly.
+func setupResolver(raw string) {
+	if raw == "" {
+		return
+	}
+	up, err := dnsserver.ParseUpstream(raw, proxy.Direct)
+	if err != nil {
+		logErrorAndExit(fmt.Sprintf("--resolver: %v", err))
+	}
+	resolver.Upstream = up
+	logInfo("using bootstrap resolver", map[string]string{"resolver": up.String()})
+}
+
+// resolveEndpoint returns every address of host as an endpoint, in answer
+// order with the preferred family first. ver restricts the family.
+func resolveEndpoint(host, port string, ver int) ([]string, error) {
+	if port == "" {
+		port = "443"
+	}
+	ips, err := resolver.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var first, second []string
+	for _, ip := range ips {
+		isV6 := ip.To4() == nil
+		if (ver == scanner.V4 && isV6) || (ver == scanner.V6 && !isV6) {
+			continue
+		}
+		ep := net.JoinHostPort(ip.String(), port)
+		if isV6 == useIpv6 {
+			first = append(first, ep)
+		} else {
+			second = append(second, ep)
+		}
+	}
+	out := dedupe(append(first, second...))
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s has no IPv%d addresses", host, map[int]int{scanner.V4: 4, scanner.V6: 6}[ver])
+	}
+	return out, nil
+}
+
+// resolveListed replaces hostname entries of an endpoints list with their
+// addresses, so every candidate is dialed exactly as probed instead of
+// through the config's endpoint_v4/endpoint_v6. Hosts that fail to
+// resolve are logged and dropped.
+func resolveListed(eps []string, ver int) []string {
+	var out []string
+	for _, ep := range eps {
+		host, port, err := net.SplitHostPort(ep)
+		if err != nil || net.ParseIP(host) != nil {
+			out = append(out, ep)
+			continue
+		}
+		addrs, err := resolveEndpoint(host, port, ver)
+		if err != nil {
+			logutil.Warn("skipping unresolvable endpoints list entry", map[string]string{"host": host, "error": err.Error()})
+			continue
+		}
+		out = append(out, addrs...)
+	}
+	return dedupe(out)
+}
+
+func dedupe(in []string) []string {
+	seen := make(map[string]bool, len(in))
+	out := in[:0]
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// watchHostname re-resolves host every interval and stores the answer in
+// resolvedEndpoints. When the endpoint in use (activeEndpoint) drops out of
+// it, it asks the supervisor to switch to the first address that is still
+// (or newly) published. Lookup failures are logged and the current
+// endpoint is kept.
+func watchHostname(host, port string, ver int, interval time.Duration, restart chan<- restartReq) {
+	for range time.Tick(interval) {
+		gen := tunnelGen.Load()
+		current, _ := activeEndpoint.Load().(string)
+		eps, err := resolveEndpoint(host, port, ver)
+		if err != nil {
+			logutil.Warn("re-resolution failed; keeping endpoint", map[string]string{
+				"host":     host,
+				"endpoint": current,
+				"error":    err.Error(),
+			})
+			continue
+		}
+		resolvedEndpoints.Store(eps)
+		if contains(eps, current) {
+			continue
+		}
+		logutil.Info("endpoint record changed", map[string]string{
+			"host": host,
+			"old":  current,
+			"new":  strings.Join(eps, ","),
+		})
+		requestRestart(restart, restartReq{Reason: "dns record changed", Endpoint: eps[0], Gen: gen})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
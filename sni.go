@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"masque-plus/internal/scanner"
+)
+
+// loadSNIList parses --sni-list: the path of a file with one SNI per line
+// ("#" starts a comment), or else a comma-separated list.
+func loadSNIList(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	f, err := os.Open(v)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return splitCSV(v), nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, sc.Err()
+}
+
+// pickSNI probes ep with every SNI in list, prints the results and returns
+// the first that completed a handshake (the first of list if none did).
+func pickSNI(ep string, list []string) string {
+	results := scanner.ProbeSNIs(ep, list, tunnelProbe())
+	scanner.PrintSNIs(os.Stdout, scanner.SNIInfos(results))
+	for _, r := range results {
+		if r.Err == nil {
+			logInfo("selected SNI", map[string]string{"endpoint": ep, "sni": r.SNI})
+			return r.SNI
+		}
+	}
+	logInfo("no SNI completed a handshake; using the first", map[string]string{"endpoint": ep, "sni": list[0]})
+	return list[0]
+}
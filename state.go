@@ -6,8 +6,49 @@ import (
 )
 
 type State struct {
-    Endpoint string `json:"endpoint"`
-    Socks    string `json:"socks"`
+    Endpoint  string `json:"endpoint"`
+    Socks     string `json:"socks"`
+    Identity  string `json:"identity,omitempty"`
+    // SNI is the server name the endpoint last worked with.
+    SNI       string `json:"sni,omitempty"`
+    // Transport is the transport (quic or h2) the endpoint worked over.
+    Transport string `json:"transport,omitempty"`
+    // Networks remembers, per network (see netutil.NetworkID), how often
+    // each address family worked.
+    Networks  map[string]*FamilyStats `json:"networks,omitempty"`
+}
+
+// FamilyStats counts dual-stack outcomes for one network.
+type FamilyStats struct {
+    V4OK   int `json:"v4_ok"`
+    V4Fail int `json:"v4_fail"`
+    V6OK   int `json:"v6_ok"`
+    V6Fail int `json:"v6_fail"`
+}
+
+// PreferV6 reports whether IPv6 has the better (smoothed) track record.
+// Ties go to IPv6, as RFC 8305 recommends.
+func (f *FamilyStats) PreferV6() bool {
+    if f == nil {
+        return true
+    }
+    v4 := float64(f.V4OK+1) / float64(f.V4OK+f.V4Fail+2)
+    v6 := float64(f.V6OK+1) / float64(f.V6OK+f.V6Fail+2)
+    return v6 >= v4
+}
+
+// Record counts one outcome for the given family.
+func (f *FamilyStats) Record(v6, ok bool) {
+    switch {
+    case v6 && ok:
+        f.V6OK++
+    case v6:
+        f.V6Fail++
+    case ok:
+        f.V4OK++
+    default:
+        f.V4Fail++
+    }
 }
 
 const stateFile = "state.json"
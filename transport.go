@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"masque-plus/internal/scanner"
+)
+
+// Tunnel transports (--transport).
+const (
+	transportQUIC = "quic"
+	transportH2   = "h2"
+	transportAuto = "auto"
+)
+
+// usqueHTTP2Flag makes `usque socks` carry MASQUE over HTTP/2 on TCP
+// instead of HTTP/3 on QUIC. Builds without it can't run --transport h2.
+const usqueHTTP2Flag = "--http2"
+
+var http2Support sync.Map // usque path -> bool
+
+// usqueSupportsHTTP2 reports whether the usque at path lists
+// usqueHTTP2Flag in `usque socks --help`.
+func usqueSupportsHTTP2(path string) bool {
+	if v, ok := http2Support.Load(path); ok {
+		return v.(bool)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, path, "socks", "--help").CombinedOutput()
+	ok := strings.Contains(string(out), usqueHTTP2Flag)
+	http2Support.Store(path, ok)
+	return ok
+}
+
+// onlyPrechecks reports whether every attempt failed its precheck, i.e.
+// no candidate got far enough to start usque.
+func onlyPrechecks(attempts []scanner.Attempt) bool {
+	for _, a := range attempts {
+		if a.Reason != scanner.ReasonPrecheck {
+			return false
+		}
+	}
+	return len(attempts) > 0
+}